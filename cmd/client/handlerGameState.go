@@ -0,0 +1,17 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func handlerGameState(gs *gamelogic.GameState) func(routing.GameStateRequest) (gamelogic.Player, error) {
+	return func(req routing.GameStateRequest) (gamelogic.Player, error) {
+		if req.Username != gs.GetUsername() {
+			return gamelogic.Player{}, fmt.Errorf("this client plays as %s, not %s", gs.GetUsername(), req.Username)
+		}
+		return gs.GetPlayerSnap(), nil
+	}
+}
@@ -1,51 +1,47 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"log/slog"
 
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func handlerMove(gs *gamelogic.GameState, publishCh *amqp.Channel) func(gamelogic.ArmyMove) pubsub.AckType {
+func handlerMove(gs *gamelogic.GameState, publishBroker pubsub.Broker) pubsub.Handler[gamelogic.ArmyMove] {
 	// 📌  handlerMove function  📝 🗑️
-	return func(move gamelogic.ArmyMove) pubsub.AckType {
-		defer fmt.Print("> ")
+	return func(delivery pubsub.Delivery[gamelogic.ArmyMove]) pubsub.AckType {
+		move := delivery.Payload
 		moveOutcome := gs.HandleMove(move)
 
 		switch moveOutcome {
 		case gamelogic.MoveOutcomeSamePlayer:
-			log.Println("acknowledge type is Ack")
 			return pubsub.Ack
 		case gamelogic.MoveOutComeSafe:
-			log.Println("acknowledge type is NackReque")
 			return pubsub.Ack
 		case gamelogic.MoveOutcomeMakeWar:
-			log.Printf("Move player: %+v", move.Player)
-			log.Printf("Defender: %+v", gs.GetPlayerSnap())
 			player := gs.GetPlayerSnap()
 			warResponse := gamelogic.RecognitionOfWar{
 				Attacker: move.Player,
 				Defender: player,
 			}
+			// published with the move's context so the war records the move
+			// as its cause
 			err := pubsub.PublishJSON(
-				publishCh,
+				delivery.Context(),
+				publishBroker,
 				routing.ExchangePerilTopic,
-				routing.WarRecognitionsPrefix+"."+move.Player.Username,
+				routing.WarKey(move.Player.Username),
 				warResponse,
 			)
 
 			if err != nil {
-				log.Printf("unable to publish war response. err: %v", err)
-				return pubsub.NackRequeue
+				slog.Error("unable to publish war recognition", "exchange", routing.ExchangePerilTopic, "routing_key", routing.WarKey(move.Player.Username), "error", err)
+				return pubsub.RetryLater
 			}
-			log.Println("acknowledge type is NackDiscard")
 			return pubsub.Ack
 		}
-		fmt.Println("error: unknown move outcome")
+		slog.Error("unknown move outcome", "outcome", moveOutcome)
 		return pubsub.NackDiscard
 	}
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestHandlerMoveDeclaresWar(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := pubsub.NewMemoryBroker()
+	defer b.Close()
+	err := pubsub.DeclareTopology(ctx, b, routing.PerilTopology)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pubsub.DeclareAndBind(ctx, b, routing.ExchangePerilTopic, "wars", routing.WarPattern(), pubsub.Transient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wars, err := b.Consume(ctx, "wars", pubsub.ConsumeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gs := gamelogic.NewGameState("bob")
+	err = gs.CommandSpawn([]string{"spawn", "europe", gamelogic.RankInfantry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := pubsub.SubscribeDelivery(
+		ctx,
+		b,
+		routing.ExchangePerilTopic,
+		routing.ArmyMovesQueue("bob"),
+		routing.ArmyMovesPattern(),
+		pubsub.Transient,
+		handlerMove(gs, b),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	attacker := gamelogic.Player{
+		Username: "alice",
+		Units:    map[int]gamelogic.Unit{1: {ID: 1, Rank: gamelogic.RankCavalry, Location: "europe"}},
+	}
+	err = pubsub.PublishJSON(ctx, b, routing.ExchangePerilTopic, routing.ArmyMovesKey("alice"), gamelogic.ArmyMove{
+		Player:     attacker,
+		Units:      []gamelogic.Unit{attacker.Units[1]},
+		ToLocation: "europe",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case d := <-wars:
+		if d.RoutingKey != routing.WarKey("alice") {
+			t.Errorf("war published with key %q, want %q", d.RoutingKey, routing.WarKey("alice"))
+		}
+		var war gamelogic.RecognitionOfWar
+		err := json.Unmarshal(d.Body, &war)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if war.Attacker.Username != "alice" || war.Defender.Username != "bob" {
+			t.Errorf("war between %s and %s, want alice and bob", war.Attacker.Username, war.Defender.Username)
+		}
+		d.Ack(false)
+	case <-time.After(time.Second):
+		t.Fatal("no war declared")
+	}
+}
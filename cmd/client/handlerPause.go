@@ -1,8 +1,6 @@
 package main
 
 import (
-	"fmt"
-
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
@@ -11,7 +9,6 @@ import (
 func handlerPause(gs *gamelogic.GameState) func(routing.PlayingState) pubsub.AckType {
 	// 📌  handlerPause function defer 📝 🗑️
 	return func(ps routing.PlayingState) pubsub.AckType {
-		defer fmt.Print("> ")
 		gs.HandlePause(ps)
 		return pubsub.Ack
 
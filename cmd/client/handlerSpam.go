@@ -1,45 +1,60 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"log"
+	"fmt"
 	"strconv"
 	"time"
 
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func handlerSpam(userInput []string, username string, channel *amqp.Channel) error {
+// spamBatchSize caps how many logs wait for their confirms at once.
+const spamBatchSize = 1000
+
+func handlerSpam(ctx context.Context, userInput []string, username string, broker pubsub.Broker) error {
 	if len(userInput) != 2 {
-		log.Println("please provide a value for the number of spams")
-		return errors.New("invalid number of inputs")
+		return errors.New("usage: spam <n>")
 	}
 	numOfSpams, err := strconv.Atoi(userInput[1])
 	if err != nil {
-		log.Println("please provide a valid integer number")
-		return err
+		return fmt.Errorf("spam needs a whole number of logs: %w", err)
 	}
-	for i := 0; i < numOfSpams; i++ {
-		maliciousString := gamelogic.GetMaliciousLog()
-		maliciousGameLog := routing.GameLog{
-			CurrentTime: time.Now(),
-			Message:     maliciousString,
-			Username:    username,
+
+	failed := 0
+	for sent := 0; sent < numOfSpams; sent += spamBatchSize {
+		maliciousGameLogs := make([]routing.GameLog, min(spamBatchSize, numOfSpams-sent))
+		for i := range maliciousGameLogs {
+			maliciousGameLogs[i] = routing.GameLog{
+				CurrentTime: time.Now(),
+				Message:     gamelogic.GetMaliciousLog(),
+				Username:    username,
+			}
 		}
 
-		//publish Malicious gamelog as GO binary using publishGob
-		err := pubsub.PublishGob(
-			channel,
+		//publish Malicious gamelogs as GO binary in one batch
+		err := pubsub.PublishBatch(
+			ctx,
+			broker,
+			pubsub.ContentTypeGob,
 			routing.ExchangePerilTopic,
-			routing.GameLogSlug+"."+username,
-			maliciousGameLog,
+			routing.GameLogKey(username),
+			maliciousGameLogs,
 		)
+		var batchErr *pubsub.BatchError
+		if errors.As(err, &batchErr) {
+			failed += len(batchErr.Failed())
+			continue
+		}
 		if err != nil {
 			return err
 		}
 	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d logs were not published", failed, numOfSpams)
+	}
 	return nil
 }
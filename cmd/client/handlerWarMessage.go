@@ -1,19 +1,18 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-func handlerWarMessage(gs *gamelogic.GameState, channel *amqp.Channel) func(gamelogic.RecognitionOfWar) pubsub.AckType {
-	return func(war gamelogic.RecognitionOfWar) pubsub.AckType {
-		defer fmt.Print("> ")
+func handlerWarMessage(gs *gamelogic.GameState, broker pubsub.Broker) pubsub.Handler[gamelogic.RecognitionOfWar] {
+	return func(delivery pubsub.Delivery[gamelogic.RecognitionOfWar]) pubsub.AckType {
+		war := delivery.Payload
+		ctx := delivery.Context()
 
 		outcome, winner, loser := gs.HandleWar(war)
 
@@ -32,31 +31,31 @@ func handlerWarMessage(gs *gamelogic.GameState, channel *amqp.Channel) func(game
 
 		case gamelogic.WarOutcomeOpponentWon:
 			gameLog.Message = winner + "won a war against" + loser
-			err := pubsub.PublishGameLog(gameLog, channel)
+			err := pubsub.PublishGameLog(ctx, gameLog, broker)
 			if err != nil {
-				return pubsub.NackRequeue
+				return pubsub.RetryLater
 			}
 
 			return pubsub.Ack
 
 		case gamelogic.WarOutcomeDraw:
 			gameLog.Message = "A war between" + winner + "and" + loser + "resulted in a draw"
-			err := pubsub.PublishGameLog(gameLog, channel)
+			err := pubsub.PublishGameLog(ctx, gameLog, broker)
 			if err != nil {
-				return pubsub.NackRequeue
+				return pubsub.RetryLater
 			}
 			return pubsub.Ack
 
 		case gamelogic.WarOutcomeYouWon:
 			gameLog.Message = winner + "won a war against" + loser
-			err := pubsub.PublishGameLog(gameLog, channel)
+			err := pubsub.PublishGameLog(ctx, gameLog, broker)
 			if err != nil {
-				return pubsub.NackRequeue
+				return pubsub.RetryLater
 			}
 			return pubsub.Ack
 
 		default:
-			log.Printf("error determining game logic.\n")
+			slog.Error("unknown war outcome", "outcome", outcome)
 			return pubsub.NackDiscard
 		}
 	}
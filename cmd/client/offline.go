@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/config"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// newOfflineBroker returns an in-process broker with topology declared and
+// a game log consumer attached, standing in for both RabbitMQ and the Peril
+// server.
+func newOfflineBroker(ctx context.Context, cfg config.Config, topology routing.Topology) (*pubsub.MemoryBroker, error) {
+	broker := pubsub.NewMemoryBroker()
+
+	err := pubsub.DeclareTopology(ctx, broker, topology)
+	if err != nil {
+		return nil, err
+	}
+
+	gameLogQueue, _ := topology.Queue(cfg.Queue(routing.QueueGameLogs))
+	_, err = pubsub.SubscribeGob(
+		ctx,
+		broker,
+		routing.ExchangePerilTopic,
+		cfg.Queue(routing.QueueGameLogs),
+		routing.GameLogPattern(),
+		pubsub.Durable,
+		func(gameLog routing.GameLog) pubsub.AckType {
+			err := gamelogic.WriteLog(gameLog)
+			if err != nil {
+				return pubsub.NackDiscard
+			}
+			return pubsub.Ack
+		},
+		pubsub.WithQueueOptions(gameLogQueue.QueueOptions),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return broker, nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// knownPayloads are the types gob bodies are tried against, since gob can
+// only decode into a concrete type.
+var knownPayloads = []func() any{
+	func() any { return &routing.GameLog{} },
+	func() any { return &routing.PlayingState{} },
+	func() any { return &gamelogic.ArmyMove{} },
+	func() any { return &gamelogic.RecognitionOfWar{} },
+}
+
+func handlerList(ctx context.Context, connection *pubsub.Connection, queue string) error {
+	ch, messages, err := fetchAll(ctx, connection, queue)
+	if err != nil {
+		return err
+	}
+	// closing the channel requeues everything that was fetched
+	defer ch.Close()
+
+	if len(messages) == 0 {
+		fmt.Println("the dead letter queue is empty")
+		return nil
+	}
+	for i, message := range messages {
+		fmt.Print(describe(i+1, message))
+	}
+	return nil
+}
+
+func handlerReplay(ctx context.Context, connection *pubsub.Connection, queue string, selection []string) error {
+	ch, messages, err := fetchAll(ctx, connection, queue)
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	replayed := 0
+	for i, message := range messages {
+		if !selected(i+1, message, selection) {
+			continue
+		}
+		exchange, key := replayRoute(message)
+		err := connection.Publish(ctx, exchange, key, replayPublishing(message))
+		if err != nil {
+			fmt.Printf("#%d: unable to replay to %s/%s: %v\n", i+1, exchange, key, err)
+			continue
+		}
+		err = message.Ack(false)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("#%d: replayed to %s/%s\n", i+1, exchange, key)
+		replayed++
+	}
+	fmt.Printf("replayed %d of %d messages\n", replayed, len(messages))
+	return nil
+}
+
+func handlerPurge(ctx context.Context, connection *pubsub.Connection, queue string, selection []string) error {
+	ch, messages, err := fetchAll(ctx, connection, queue)
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	purged := 0
+	for i, message := range messages {
+		if !selected(i+1, message, selection) {
+			continue
+		}
+		err := message.Ack(false)
+		if err != nil {
+			return err
+		}
+		purged++
+	}
+	fmt.Printf("purged %d of %d messages\n", purged, len(messages))
+	return nil
+}
+
+// fetchAll takes every message off the dead letter queue without acking
+// it. Messages that are not acked go back to the queue, in their original
+// order, when the returned channel is closed.
+func fetchAll(ctx context.Context, connection *pubsub.Connection, queue string) (*amqp.Channel, []amqp.Delivery, error) {
+	ch, err := connection.Channel(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var messages []amqp.Delivery
+	for {
+		message, ok, err := ch.Get(queue, false)
+		if err != nil {
+			ch.Close()
+			return nil, nil, err
+		}
+		if !ok {
+			return ch, messages, nil
+		}
+		messages = append(messages, message)
+	}
+}
+
+func selected(number int, message amqp.Delivery, selection []string) bool {
+	for _, s := range selection {
+		if s == "all" || s == strconv.Itoa(number) || (message.MessageId != "" && s == message.MessageId) {
+			return true
+		}
+	}
+	return false
+}
+
+func describe(number int, message amqp.Delivery) string {
+	var b strings.Builder
+	exchange, key, queue := origin(message)
+
+	fmt.Fprintf(&b, "#%d", number)
+	if message.MessageId != "" {
+		fmt.Fprintf(&b, " id=%s", message.MessageId)
+	}
+	fmt.Fprintf(&b, " route=%s/%s", exchange, key)
+	if queue != "" {
+		fmt.Fprintf(&b, " queue=%s", queue)
+	}
+	fmt.Fprintf(&b, " type=%s\n", message.ContentType)
+	fmt.Fprintf(&b, "    reason:  %s\n", reason(message))
+	fmt.Fprintf(&b, "    payload: %s\n", payload(message))
+	return b.String()
+}
+
+// origin returns where a message was headed before it was dead-lettered:
+// the route pubsub recorded when it moved the message itself, otherwise the
+// most recent x-death entry.
+func origin(message amqp.Delivery) (exchange, key, queue string) {
+	if key, ok := message.Headers[pubsub.HeaderOriginalRoutingKey].(string); ok {
+		exchange, _ := message.Headers[pubsub.HeaderOriginalExchange].(string)
+		queue, _ := message.Headers[pubsub.HeaderOriginalQueue].(string)
+		return exchange, key, queue
+	}
+	if death, ok := lastDeath(message); ok {
+		exchange, _ := death["exchange"].(string)
+		queue, _ := death["queue"].(string)
+		key := message.RoutingKey
+		if keys, ok := death["routing-keys"].([]interface{}); ok && len(keys) > 0 {
+			key, _ = keys[0].(string)
+		}
+		return exchange, key, queue
+	}
+	return message.Exchange, message.RoutingKey, ""
+}
+
+func reason(message amqp.Delivery) string {
+	if cause, ok := message.Headers[pubsub.HeaderError].(string); ok {
+		return cause
+	}
+	if death, ok := lastDeath(message); ok {
+		return fmt.Sprintf("%v (%v times)", death["reason"], death["count"])
+	}
+	return "unknown"
+}
+
+func lastDeath(message amqp.Delivery) (amqp.Table, bool) {
+	deaths, _ := message.Headers["x-death"].([]interface{})
+	if len(deaths) == 0 {
+		return nil, false
+	}
+	death, ok := deaths[0].(amqp.Table)
+	return death, ok
+}
+
+func payload(message amqp.Delivery) string {
+	codec, err := pubsub.LookupCodec(message.ContentType)
+	if err != nil {
+		return fmt.Sprintf("%q", message.Body)
+	}
+
+	var v any
+	if codec.Unmarshal(message.Body, &v) == nil {
+		return fmt.Sprintf("%v", v)
+	}
+	for _, newPayload := range knownPayloads {
+		v := newPayload()
+		if codec.Unmarshal(message.Body, v) == nil {
+			return fmt.Sprintf("%+v", v)
+		}
+	}
+	return fmt.Sprintf("undecodable %s: %q", message.ContentType, message.Body)
+}
+
+// replayRoute returns where a message is replayed to: straight back to the
+// queue it was dead-lettered from, through the default exchange the way
+// retries go back, so other queues bound with the same key do not get it a
+// second time. Only a message whose queue is unknown is published to its
+// original exchange again.
+func replayRoute(message amqp.Delivery) (exchange, key string) {
+	exchange, key, queue := origin(message)
+	if queue == "" {
+		return exchange, key
+	}
+	return "", queue
+}
+
+// replayPublishing copies message for publishing again, without the
+// headers recording its trip to the dead letter queue. Its metadata is
+// kept, so the replayed message is still traceable to what caused it, and
+// so is its original route, which pubsub restores on delivery.
+func replayPublishing(message amqp.Delivery) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range message.Headers {
+		if k == "x-death" || strings.HasPrefix(k, "x-first-death-") || strings.HasPrefix(k, "x-last-death-") {
+			continue
+		}
+		if strings.HasPrefix(k, "x-peril-") && k != pubsub.HeaderSender && k != pubsub.HeaderCorrelationID && k != pubsub.HeaderCausationID {
+			continue
+		}
+		headers[k] = v
+	}
+	if exchange, key, queue := origin(message); queue != "" {
+		headers[pubsub.HeaderOriginalExchange] = exchange
+		headers[pubsub.HeaderOriginalRoutingKey] = key
+		headers[pubsub.HeaderOriginalQueue] = queue
+	}
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     message.ContentType,
+		ContentEncoding: message.ContentEncoding,
+		DeliveryMode:    message.DeliveryMode,
+		Priority:        message.Priority,
+		CorrelationId:   message.CorrelationId,
+		ReplyTo:         message.ReplyTo,
+		MessageId:       message.MessageId,
+		Timestamp:       message.Timestamp,
+		Type:            message.Type,
+		AppId:           message.AppId,
+		Body:            message.Body,
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestReplay(t *testing.T) {
+	tests := []struct {
+		name         string
+		message      amqp.Delivery
+		wantExchange string
+		wantKey      string
+		wantOrigin   bool
+	}{
+		{
+			name: "rejected by pubsub",
+			message: amqp.Delivery{
+				Exchange:   "peril_dlx",
+				RoutingKey: "game_logs.alice",
+				Headers: amqp.Table{
+					pubsub.HeaderError:              "invalid character",
+					pubsub.HeaderOriginalExchange:   "peril_topic",
+					pubsub.HeaderOriginalRoutingKey: "game_logs.alice",
+					pubsub.HeaderOriginalQueue:      "game_logs",
+					pubsub.HeaderSender:             "alice",
+				},
+			},
+			wantKey:    "game_logs",
+			wantOrigin: true,
+		},
+		{
+			name: "dead-lettered by the broker",
+			message: amqp.Delivery{
+				Exchange:   "peril_dlx",
+				RoutingKey: "game_logs.alice",
+				Headers: amqp.Table{
+					"x-death": []interface{}{amqp.Table{
+						"exchange":     "peril_topic",
+						"queue":        "game_logs",
+						"reason":       "rejected",
+						"routing-keys": []interface{}{"game_logs.alice"},
+					}},
+					"x-first-death-reason": "rejected",
+					pubsub.HeaderSender:    "alice",
+				},
+			},
+			wantKey:    "game_logs",
+			wantOrigin: true,
+		},
+		{
+			name: "published to the dead letter exchange",
+			message: amqp.Delivery{
+				Exchange:   "peril_dlx",
+				RoutingKey: "game_logs.alice",
+				Headers:    amqp.Table{pubsub.HeaderSender: "alice"},
+			},
+			wantExchange: "peril_dlx",
+			wantKey:      "game_logs.alice",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exchange, key := replayRoute(tt.message)
+			if exchange != tt.wantExchange || key != tt.wantKey {
+				t.Errorf("replayed to %q/%q, want %q/%q", exchange, key, tt.wantExchange, tt.wantKey)
+			}
+
+			headers := replayPublishing(tt.message).Headers
+			for _, k := range []string{"x-death", "x-first-death-reason", pubsub.HeaderError} {
+				if _, ok := headers[k]; ok {
+					t.Errorf("replayed with %s", k)
+				}
+			}
+			if headers[pubsub.HeaderSender] != "alice" {
+				t.Errorf("replayed with sender %v", headers[pubsub.HeaderSender])
+			}
+			if !tt.wantOrigin {
+				return
+			}
+			if headers[pubsub.HeaderOriginalExchange] != "peril_topic" || headers[pubsub.HeaderOriginalRoutingKey] != "game_logs.alice" || headers[pubsub.HeaderOriginalQueue] != "game_logs" {
+				t.Errorf("replayed with origin %v %v %v", headers[pubsub.HeaderOriginalExchange], headers[pubsub.HeaderOriginalRoutingKey], headers[pubsub.HeaderOriginalQueue])
+			}
+		})
+	}
+}
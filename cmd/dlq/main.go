@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/cli"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/config"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: dlq [flags] <command> [selection...]
+
+Inspects the Peril dead letter queue.
+
+Commands:
+  list                   print every dead-lettered message
+  replay <selection...>  publish the selected messages back to the queue they came from
+  purge <selection...>   drop the selected messages
+
+A selection is a message number as printed by list, a message ID, or "all".
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	logFormat := flag.String("log-format", "text", "log format, text or json")
+	var logLevel slog.Level
+	flag.TextVar(&logLevel, "log-level", slog.LevelInfo, "minimum level logged: debug, info, warn or error")
+	configFlags := config.RegisterFlags(flag.CommandLine)
+	flag.Usage = usage
+	flag.Parse()
+
+	logger, err := cli.SetupLogging(*logFormat, logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	cfg, err := configFlags.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	command, selection := args[0], args[1:]
+	if command != "list" && len(selection) == 0 {
+		fmt.Fprintf(os.Stderr, "%s needs a selection, use \"all\" to %s everything\n", command, command)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	connection, err := cfg.Dial(ctx)
+	if err != nil {
+		logger.Error("unable to connect to broker", "error", err)
+		os.Exit(1)
+	}
+	defer connection.Close()
+
+	queue := cfg.Queue(routing.QueuePerilDeadLetter)
+	err = declareDeadLetterTopology(ctx, connection, queue)
+	if err != nil {
+		logger.Error("unable to declare dead letter topology", "queue", queue, "error", err)
+		connection.Close()
+		os.Exit(1)
+	}
+
+	switch command {
+	case "list":
+		err = handlerList(ctx, connection, queue)
+	case "replay":
+		err = handlerReplay(ctx, connection, queue, selection)
+	case "purge":
+		err = handlerPurge(ctx, connection, queue, selection)
+	default:
+		connection.Close()
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		logger.Error("command failed", "command", command, "error", err)
+		connection.Close()
+		os.Exit(1)
+	}
+}
+
+// declareDeadLetterTopology makes sure peril_dlx exists and everything
+// dead-lettered to it is kept in queue.
+func declareDeadLetterTopology(ctx context.Context, connection *pubsub.Connection, queue string) error {
+	err := connection.DeclareExchange(ctx, routing.ExchangePerilDeadLetter, amqp.ExchangeFanout)
+	if err != nil {
+		return err
+	}
+	_, err = connection.DeclareQueue(ctx, queue, true, false, false, nil)
+	if err != nil {
+		return err
+	}
+	return connection.BindQueue(ctx, queue, "", routing.ExchangePerilDeadLetter)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/cli"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/config"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: history [flags]
+
+Prints the game logs kept in the %s stream, which the server declares
+when started with -game-log-stream, and keeps printing new ones until
+interrupted.
+
+Flags:
+`, routing.StreamGameLogs)
+	flag.PrintDefaults()
+}
+
+func main() {
+	logFormat := flag.String("log-format", "text", "log format, text or json")
+	var logLevel slog.Level
+	flag.TextVar(&logLevel, "log-level", slog.LevelInfo, "minimum level logged: debug, info, warn or error")
+	configFlags := config.RegisterFlags(flag.CommandLine)
+	from := flag.String("from", "first", "where to start: first, last, next, an offset or an RFC 3339 time")
+	offsetFile := flag.String("offset-file", "", "file to resume from and record progress in; -from only applies the first time")
+	name := flag.String("name", "history", "name progress is recorded under in the offset file")
+	flag.Usage = usage
+	flag.Parse()
+
+	logger, err := cli.SetupLogging(*logFormat, logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	cfg, err := configFlags.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	offset, err := parseOffset(*from)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *offsetFile != "" {
+		store, err := pubsub.OpenFileOffsetStore(*offsetFile)
+		if err != nil {
+			logger.Error("unable to open offset file", "path", *offsetFile, "error", err)
+			os.Exit(1)
+		}
+		offset = pubsub.OffsetStored(store, *name, offset)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	connection, err := cfg.Dial(ctx)
+	if err != nil {
+		logger.Error("unable to connect to broker", "error", err)
+		os.Exit(1)
+	}
+	defer connection.Close()
+
+	sub, err := pubsub.SubscribeStream(
+		ctx,
+		connection,
+		cfg.Queue(routing.StreamGameLogs),
+		offset,
+		func(d pubsub.Delivery[routing.GameLog]) pubsub.AckType {
+			n, _ := d.StreamOffset()
+			gameLog := d.Payload
+			fmt.Printf("#%d %s %s: %s\n", n, gameLog.CurrentTime.Format(time.RFC3339), gameLog.Username, gameLog.Message)
+			return pubsub.Ack
+		},
+	)
+	if err != nil {
+		logger.Error("unable to read stream", "stream", routing.StreamGameLogs, "error", err)
+		connection.Close()
+		os.Exit(1)
+	}
+	err = sub.Wait()
+	if err != nil {
+		logger.Error("reading stream failed", "stream", routing.StreamGameLogs, "error", err)
+		connection.Close()
+		os.Exit(1)
+	}
+}
+
+// parseOffset reads -from.
+func parseOffset(from string) (pubsub.StreamOffset, error) {
+	switch from {
+	case "first":
+		return pubsub.OffsetFirst, nil
+	case "last":
+		return pubsub.OffsetLast, nil
+	case "next":
+		return pubsub.OffsetNext, nil
+	}
+	if n, err := strconv.ParseInt(from, 10, 64); err == nil && n >= 0 {
+		return pubsub.OffsetAt(n), nil
+	}
+	if t, err := time.Parse(time.RFC3339, from); err == nil {
+		return pubsub.OffsetTimestamp(t), nil
+	}
+	return pubsub.StreamOffset{}, fmt.Errorf("-from %q: want first, last, next, an offset or an RFC 3339 time", from)
+}
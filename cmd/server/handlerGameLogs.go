@@ -1,8 +1,6 @@
 package main
 
 import (
-	"fmt"
-
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
 	routing "github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
@@ -10,7 +8,6 @@ import (
 
 func handlerGameLogs() func(routing.GameLog) pubsub.AckType {
 	return func(gameLog routing.GameLog) pubsub.AckType {
-		defer fmt.Print("> ")
 		err := gamelogic.WriteLog(gameLog)
 		if err != nil {
 			return pubsub.NackDiscard
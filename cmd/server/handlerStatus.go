@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// handlerStatus asks a connected client for its current units and prints
+// them.
+func handlerStatus(ctx context.Context, broker pubsub.Broker, words []string) error {
+	if len(words) < 2 {
+		return errors.New("usage: status <username>")
+	}
+	username := words[1]
+
+	player, err := pubsub.Request[routing.GameStateRequest, gamelogic.Player](ctx, broker,
+		routing.ExchangePerilDirect,
+		routing.GameStateKey(username),
+		routing.GameStateRequest{Username: username},
+	)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s has %d units.\n", player.Username, len(player.Units))
+	for _, unit := range player.Units {
+		fmt.Printf("* %v: %v, %v\n", unit.ID, unit.Location, unit.Rank)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// topologyBroker is a broker that can both inspect and declare, such as a
+// *pubsub.Connection.
+type topologyBroker interface {
+	pubsub.Broker
+	pubsub.Inspector
+}
+
+// reconcileTopology reports what the broker is missing from topology, then
+// declares it. Missing exchanges and queues, as on a fresh broker, are
+// expected and only noted. Those that exist with other settings are drift:
+// the broker refuses to redeclare them with PRECONDITION_FAILED, and they
+// are left alone and warned about rather than stopping the server. Any
+// other error declaring the topology is returned.
+func reconcileTopology(ctx context.Context, logger *slog.Logger, broker topologyBroker, topology routing.Topology) error {
+	drift, err := pubsub.VerifyTopology(ctx, broker, topology)
+	if err != nil {
+		return fmt.Errorf("verifying topology: %w", err)
+	}
+	for _, d := range drift {
+		if d.Missing() {
+			logger.Info("declaring missing topology", "kind", d.Kind, "name", d.Name)
+			continue
+		}
+		logger.Warn("topology drift", "kind", d.Kind, "name", d.Name, "problem", d.Problem)
+	}
+
+	var failed []error
+	for _, err := range unjoin(pubsub.DeclareTopology(ctx, broker, topology)) {
+		if isDrift(err) {
+			logger.Warn("topology drift, broker differs from spec", "error", err)
+			continue
+		}
+		failed = append(failed, err)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("declaring topology: %w", errors.Join(failed...))
+	}
+	return nil
+}
+
+// unjoin splits an error made by errors.Join into the errors it joined.
+func unjoin(err error) []error {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
+
+func isDrift(err error) bool {
+	var amqpErr *amqp.Error
+	return errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// refusingBroker refuses every binding, as a broker does for a user
+// without permission to bind.
+type refusingBroker struct {
+	*pubsub.MemoryBroker
+}
+
+func (b refusingBroker) BindQueue(ctx context.Context, queueName, key, exchange string) error {
+	return &amqp.Error{Code: amqp.AccessRefused, Reason: "ACCESS_REFUSED - access to exchange 'peril_topic' refused"}
+}
+
+func TestReconcileTopology(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(*pubsub.MemoryBroker) topologyBroker
+		wantLog string
+		wantErr bool
+	}{
+		{
+			name:    "fresh broker",
+			prepare: func(b *pubsub.MemoryBroker) topologyBroker { return b },
+			wantLog: "declaring missing topology",
+		},
+		{
+			name: "drifted queue",
+			prepare: func(b *pubsub.MemoryBroker) topologyBroker {
+				b.DeclareQueue(context.Background(), routing.QueueWar, false, true, false, nil)
+				return b
+			},
+			wantLog: "topology drift",
+		},
+		{
+			name:    "refused binding",
+			prepare: func(b *pubsub.MemoryBroker) topologyBroker { return refusingBroker{b} },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := pubsub.NewMemoryBroker()
+			defer b.Close()
+			var logs bytes.Buffer
+			logger := slog.New(slog.NewTextHandler(&logs, nil))
+
+			err := reconcileTopology(context.Background(), logger, tt.prepare(b), routing.PerilTopology)
+			if tt.wantErr {
+				var amqpErr *amqp.Error
+				if !errors.As(err, &amqpErr) || amqpErr.Code != amqp.AccessRefused {
+					t.Errorf("got %v, want ACCESS_REFUSED", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(logs.String(), tt.wantLog) {
+				t.Errorf("logged %q, want %q", logs.String(), tt.wantLog)
+			}
+		})
+	}
+}
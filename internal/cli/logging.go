@@ -0,0 +1,33 @@
+// Package cli holds what the Peril commands share on the command line:
+// logging setup and the interactive prompt.
+package cli
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+)
+
+// SetupLogging sends the command's, pubsub's and gamelogic's logs to stderr
+// as text or, for ingestion, as JSON lines.
+func SetupLogging(format string, level slog.Level) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q, want text or json", format)
+	}
+
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+	pubsub.SetLogger(logger)
+	gamelogic.SetLogger(logger)
+	return logger, nil
+}
@@ -0,0 +1,16 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+)
+
+// Prompt is middleware printing the input prompt again after a handler
+// wrote over it.
+func Prompt[T any](next pubsub.Handler[T]) pubsub.Handler[T] {
+	return func(d pubsub.Delivery[T]) pubsub.AckType {
+		defer fmt.Print("> ")
+		return next(d)
+	}
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadQuotas reads per player game log limits from a YAML or JSON file of
+// the form
+//
+//	default: {rate: 10, burst: 20}
+//	players:
+//	  alice: {rate: 50, burst: 100}
+//	  bob: {rate: 0}
+//
+// over quotas, so the file only needs to name what it changes. A rate of 0
+// lifts the limit. quotas itself is left as it was.
+func LoadQuotas(path string, quotas pubsub.Quotas) (pubsub.Quotas, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return pubsub.Quotas{}, fmt.Errorf("quotas: %w", err)
+	}
+	// the decoder adds to the map it is given, which is the caller's
+	quotas.Players = maps.Clone(quotas.Players)
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(&quotas)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return pubsub.Quotas{}, fmt.Errorf("quotas %s: %w", path, err)
+	}
+	err = validateLimit("default", quotas.Default)
+	if err != nil {
+		return pubsub.Quotas{}, fmt.Errorf("quotas %s: %w", path, err)
+	}
+	for username, limit := range quotas.Players {
+		err = validateLimit(username, limit)
+		if err != nil {
+			return pubsub.Quotas{}, fmt.Errorf("quotas %s: %w", path, err)
+		}
+	}
+	return quotas, nil
+}
+
+func validateLimit(name string, limit pubsub.Limit) error {
+	if limit.Rate < 0 || limit.Burst < 0 {
+		return fmt.Errorf("%s: rate and burst must not be negative", name)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+)
+
+func TestLoadQuotas(t *testing.T) {
+	flags := pubsub.Quotas{
+		Default: pubsub.Limit{Rate: 10, Burst: 20},
+		Players: map[string]pubsub.Limit{"carol": {Rate: 5, Burst: 5}},
+	}
+	tests := []struct {
+		name    string
+		file    string
+		want    pubsub.Quotas
+		wantErr string
+	}{
+		{
+			name: "empty file keeps the flags",
+			want: flags,
+		},
+		{
+			name: "merged over the flags",
+			file: "default: {burst: 40}\nplayers:\n  alice: {rate: 50, burst: 100}\n  bob: {rate: 0}\n",
+			want: pubsub.Quotas{
+				Default: pubsub.Limit{Rate: 10, Burst: 40},
+				Players: map[string]pubsub.Limit{
+					"alice": {Rate: 50, Burst: 100},
+					"bob":   {},
+					"carol": {Rate: 5, Burst: 5},
+				},
+			},
+		},
+		{
+			name: "json",
+			file: `{"default": {"rate": 1, "burst": 1}}`,
+			want: pubsub.Quotas{Default: pubsub.Limit{Rate: 1, Burst: 1}, Players: flags.Players},
+		},
+		{name: "unknown field", file: "default: {rate: 1, brust: 2}\n", wantErr: "brust"},
+		{name: "negative default", file: "default: {rate: -1}\n", wantErr: "default: rate and burst must not be negative"},
+		{name: "negative player", file: "players:\n  alice: {rate: 1, burst: -2}\n", wantErr: "alice: rate and burst must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LoadQuotas(writeFile(t, "quotas.yaml", tt.file), flags)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got %v, want an error about %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if len(flags.Players) != 1 {
+				t.Errorf("loading changed the players passed in to %v", flags.Players)
+			}
+		})
+	}
+
+	_, err := LoadQuotas(writeFile(t, "quotas.yaml", "")+".missing", flags)
+	if err == nil {
+		t.Error("loaded a missing file")
+	}
+}
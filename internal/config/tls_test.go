@@ -0,0 +1,165 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// writeCert writes a self-signed certificate and its key as PEM files,
+// standing in for both the CA and the client certificate.
+func writeCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "peril"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = writeFile(t, "cert.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	keyFile = writeFile(t, "key.pem", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+	return certFile, keyFile
+}
+
+func TestValidateTLSAndExternal(t *testing.T) {
+	cert, key := writeCert(t)
+	notPEM := writeFile(t, "ca.txt", "not a certificate")
+	const amqps = "amqps://rabbit.example:5671/"
+	withTLS := func(url string, tls TLS) Config {
+		cfg := Default()
+		cfg.URL = url
+		cfg.TLS = tls
+		return cfg
+	}
+	external := func(cfg Config) Config {
+		cfg.Auth = AuthExternal
+		return cfg
+	}
+	mutual := TLS{CAFile: cert, CertFile: cert, KeyFile: key}
+
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr string
+	}{
+		{name: "amqps with a ca", cfg: withTLS(amqps, TLS{CAFile: cert})},
+		{name: "amqps with a client certificate", cfg: withTLS(amqps, mutual)},
+		{name: "external", cfg: external(withTLS(amqps, mutual))},
+		{name: "amqps without a ca", cfg: withTLS(amqps, TLS{}), wantErr: "needs a tls ca"},
+		{name: "amqps with only a client certificate", cfg: withTLS(amqps, TLS{CertFile: cert, KeyFile: key}), wantErr: "needs a tls ca"},
+		{name: "tls on an amqp url", cfg: withTLS(Default().URL, TLS{CAFile: cert}), wantErr: "need an amqps url"},
+		{name: "cert without key", cfg: withTLS(amqps, TLS{CAFile: cert, CertFile: cert}), wantErr: "cert and key"},
+		{name: "key without cert", cfg: withTLS(amqps, TLS{CAFile: cert, KeyFile: key}), wantErr: "cert and key"},
+		{name: "ca not PEM", cfg: withTLS(amqps, TLS{CAFile: notPEM}), wantErr: "no PEM certificates"},
+		{name: "ca missing", cfg: withTLS(amqps, TLS{CAFile: notPEM + ".missing"}), wantErr: "tls ca"},
+		{name: "key not matching", cfg: withTLS(amqps, TLS{CAFile: cert, CertFile: cert, KeyFile: notPEM}), wantErr: "tls cert"},
+		{name: "external without tls", cfg: external(Default()), wantErr: "external auth needs"},
+		{name: "external without a client certificate", cfg: external(withTLS(amqps, TLS{CAFile: cert})), wantErr: "external auth needs"},
+		{
+			name: "external with a password",
+			cfg: func() Config {
+				cfg := external(withTLS(amqps, mutual))
+				cfg.Password = "s3cret"
+				return cfg
+			}(),
+			wantErr: "not a username or password",
+		},
+		{
+			name: "external with a username",
+			cfg: func() Config {
+				cfg := external(withTLS(amqps, mutual))
+				cfg.Username = "peril"
+				return cfg
+			}(),
+			wantErr: "not a username or password",
+		},
+		{
+			name: "external with player credentials",
+			cfg: func() Config {
+				cfg := external(withTLS(amqps, mutual))
+				cfg.PlayerCredentials = true
+				return cfg
+			}(),
+			wantErr: "not a username or password",
+		},
+	}
+	for _, tt := range tests {
+		err := tt.cfg.Validate()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: Validate() = %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: Validate() = %v, want an error about %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDialOptionsExternal(t *testing.T) {
+	cert, key := writeCert(t)
+	cfg := Default()
+	cfg.URL = "amqps://rabbit.example:5671/"
+	cfg.Auth = AuthExternal
+	cfg.TLS = TLS{CAFile: cert, CertFile: cert, KeyFile: key, ServerName: "rabbit.internal"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := cfg.DialOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var amqpConfig amqp.Config
+	for _, opt := range opts {
+		opt(&amqpConfig)
+	}
+	tlsConfig := amqpConfig.TLSClientConfig
+	if tlsConfig == nil || tlsConfig.RootCAs == nil || len(tlsConfig.Certificates) != 1 || tlsConfig.ServerName != "rabbit.internal" {
+		t.Fatalf("tls config %+v", tlsConfig)
+	}
+	if len(amqpConfig.SASL) != 1 || amqpConfig.SASL[0].Mechanism() != "EXTERNAL" {
+		t.Errorf("sasl %v, want EXTERNAL", amqpConfig.SASL)
+	}
+}
+
+func TestForPlayer(t *testing.T) {
+	cfg := Default()
+	cfg.Password = "s3cret"
+	if got := cfg.ForPlayer("alice"); got.Username != "" {
+		t.Errorf("logged in as %q without player credentials", got.Username)
+	}
+	cfg.PlayerCredentials = true
+	if got := cfg.ForPlayer("alice"); got.Username != "alice" || got.Password != "s3cret" {
+		t.Errorf("alice logs in as %q", got.Username)
+	}
+	if cfg.Username != "" {
+		t.Error("ForPlayer changed the shared config")
+	}
+}
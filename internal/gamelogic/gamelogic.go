@@ -42,6 +42,7 @@ func PrintServerHelp() {
 	fmt.Println("Possible commands:")
 	fmt.Println("* pause")
 	fmt.Println("* resume")
+	fmt.Println("* status <username>")
 	fmt.Println("* quit")
 	fmt.Println("* help")
 }
@@ -58,6 +59,24 @@ func GetInput() []string {
 	return strings.Fields(line)
 }
 
+// GetInputs calls GetInput in the background and sends every line on the
+// returned channel, so callers can wait for input and other events at the
+// same time. The channel is closed when stdin is closed.
+func GetInputs() <-chan []string {
+	inputs := make(chan []string)
+	go func() {
+		defer close(inputs)
+		for {
+			words := GetInput()
+			if words == nil {
+				return
+			}
+			inputs <- words
+		}
+	}()
+	return inputs
+}
+
 func GetMaliciousLog() string {
 	possibleLogs := []string{
 		"Never interrupt your enemy when he is making a mistake.",
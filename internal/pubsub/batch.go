@@ -0,0 +1,246 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Message is a message to publish with Broker.PublishBatch.
+type Message struct {
+	Exchange   string
+	Key        string
+	Publishing amqp.Publishing
+}
+
+// BatchError is returned by PublishBatch when some messages of a batch were
+// not confirmed. The others were.
+type BatchError struct {
+	// Errors has an entry for every message of the batch, nil for those
+	// that were confirmed.
+	Errors []error
+}
+
+func (e *BatchError) Error() string {
+	failed := e.Failed()
+	if len(failed) == 0 {
+		return "pubsub: batch published"
+	}
+	return fmt.Sprintf("pubsub: %d of %d messages in batch failed, first #%d: %v",
+		len(failed), len(e.Errors), failed[0], e.Errors[failed[0]])
+}
+
+// Failed returns the indexes of the messages that failed, in order.
+func (e *BatchError) Failed() []int {
+	var failed []int
+	for i, err := range e.Errors {
+		if err != nil {
+			failed = append(failed, i)
+		}
+	}
+	return failed
+}
+
+// Unwrap lets errors.Is and errors.As look at every failure.
+func (e *BatchError) Unwrap() []error {
+	var errs []error
+	for _, err := range e.Errors {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// batchResult returns nil if every entry of errs is nil and a *BatchError
+// otherwise.
+func batchResult(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return &BatchError{Errors: errs}
+		}
+	}
+	return nil
+}
+
+// PublishBatch encodes every value in vals with the codec registered for
+// contentType and publishes them all to exchange with key as one batch. It
+// returns a *BatchError naming the values that were not confirmed, or nil
+// once the broker has taken them all.
+func PublishBatch[T any](ctx context.Context, b Broker, contentType, exchange, key string, vals []T) error {
+	codec, err := LookupCodec(contentType)
+	if err != nil {
+		return err
+	}
+
+	ctx, span := startPublishSpan(ctx, exchange, key)
+	span.SetAttributes(attribute.Int("messaging.batch.message_count", len(vals)))
+	defer func() { endSpan(span, err) }()
+
+	msgs := make([]Message, len(vals))
+	for i, val := range vals {
+		var body []byte
+		body, err = codec.Marshal(val)
+		if err != nil {
+			logger().Error("unable to encode message", "exchange", exchange, "routing_key", key, "content_type", contentType, "error", err)
+			err = fmt.Errorf("message %d: %w", i, err)
+			return err
+		}
+		msgs[i] = Message{
+			Exchange: exchange,
+			Key:      key,
+			Publishing: stamp(ctx, amqp.Publishing{
+				ContentType: codec.ContentType(),
+				Body:        body,
+			}),
+		}
+	}
+
+	err = b.PublishBatch(ctx, msgs)
+	if err != nil {
+		logger().Error("unable to publish batch", "exchange", exchange, "routing_key", key, "messages", len(msgs), "error", err)
+		return err
+	}
+	return nil
+}
+
+// PublishBatch publishes every message on the publishing channel without
+// waiting in between, then waits for all their confirms. A message whose
+// confirm was lost to a connection failure is published once more on the
+// recovered connection.
+func (c *Connection) PublishBatch(ctx context.Context, msgs []Message) error {
+	errs := make([]error, len(msgs))
+	pending := make([]int, len(msgs))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	for attempt := 0; len(pending) > 0; attempt++ {
+		pub, err := c.publisher(ctx)
+		if err != nil {
+			for _, i := range pending {
+				errs[i] = err
+			}
+			break
+		}
+
+		pub.publishBatch(ctx, msgs, pending, errs)
+
+		var closed []int
+		for _, i := range pending {
+			if errors.Is(errs[i], amqp.ErrClosed) {
+				closed = append(closed, i)
+			}
+		}
+		if len(closed) == 0 || attempt > 0 {
+			break
+		}
+		c.resetPublisher(pub)
+		pending = closed
+	}
+
+	for i, msg := range msgs {
+		observePublish(msg.Exchange, msg.Key, errs[i])
+	}
+	return batchResult(errs)
+}
+
+// publishBatch publishes the messages at indexes in msgs and records the
+// outcome of each in errs. Returns carry no delivery tag, so they are
+// matched to messages by message ID; a returned message without one cannot
+// be told apart and is reported as confirmed.
+func (p *publisher) publishBatch(ctx context.Context, msgs []Message, indexes []int, errs []error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.drainReturns()
+
+	// the connection stops reading frames while a return cannot be handed
+	// over, so returns are collected while the batch is in flight
+	returned := map[string]amqp.Return{}
+	stop := make(chan struct{})
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for {
+			select {
+			case r, ok := <-p.returns:
+				if !ok {
+					return
+				}
+				returned[r.MessageId] = r
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	confirms := make(map[int]*amqp.DeferredConfirmation, len(indexes))
+	for _, i := range indexes {
+		msg := msgs[i]
+		confirm, err := p.ch.PublishWithDeferredConfirmWithContext(ctx, msg.Exchange, msg.Key, true, false, msg.Publishing)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		confirms[i] = confirm
+	}
+
+	waitCtx := ctx
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, defaultConfirmTimeout)
+		defer cancel()
+	}
+	acks := make(map[int]bool, len(confirms))
+	waitErrs := make(map[int]error)
+	for _, i := range indexes {
+		confirm, ok := confirms[i]
+		if !ok {
+			continue
+		}
+		acks[i], waitErrs[i] = confirm.WaitContext(waitCtx)
+	}
+
+	close(stop)
+	<-collected
+	for drained := false; !drained; {
+		select {
+		case r, ok := <-p.returns:
+			if ok {
+				returned[r.MessageId] = r
+			} else {
+				drained = true
+			}
+		default:
+			drained = true
+		}
+	}
+
+	closed := p.isClosed()
+	for _, i := range indexes {
+		if _, ok := confirms[i]; !ok {
+			continue
+		}
+		var ret *amqp.Return
+		if id := msgs[i].Publishing.MessageId; id != "" {
+			if r, ok := returned[id]; ok {
+				ret = &r
+			}
+		}
+		errs[i] = confirmResult(acks[i], waitErrs[i], ret, closed)
+	}
+}
+
+// PublishBatch publishes every message in turn; the memory broker has no
+// confirms to wait for.
+func (b *MemoryBroker) PublishBatch(ctx context.Context, msgs []Message) error {
+	errs := make([]error, len(msgs))
+	for i, msg := range msgs {
+		errs[i] = b.Publish(ctx, msg.Exchange, msg.Key, msg.Publishing)
+	}
+	return batchResult(errs)
+}
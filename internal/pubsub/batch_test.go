@@ -0,0 +1,177 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// batchMessages returns a batch to the topic exchange "peril" for every
+// key, with the key as the body.
+func batchMessages(keys ...string) []Message {
+	msgs := make([]Message, len(keys))
+	for i, key := range keys {
+		msgs[i] = Message{Exchange: "peril", Key: key, Publishing: amqp.Publishing{Body: []byte(key)}}
+	}
+	return msgs
+}
+
+// declareMoves declares the topic exchange "peril" and binds the queue
+// "moves" to it for moves.*.
+func declareMoves(t *testing.T, b *MemoryBroker) {
+	t.Helper()
+	err := b.DeclareExchange(context.Background(), "peril", "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	declareBound(t, b, "peril", "moves", "moves.*", nil)
+}
+
+// checkBatchError checks that err is a *BatchError with a ReturnError for
+// the message at every index in returned, ErrNacked for those in nacked and
+// nil for the rest.
+func checkBatchError(t *testing.T, err error, n int, returned, nacked []int) {
+	t.Helper()
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("got %v, want a *BatchError", err)
+	}
+	if len(batchErr.Errors) != n {
+		t.Fatalf("%d errors for %d messages", len(batchErr.Errors), n)
+	}
+	want := make([]string, n)
+	for _, i := range returned {
+		want[i] = "returned"
+	}
+	for _, i := range nacked {
+		want[i] = "nacked"
+	}
+	for i, err := range batchErr.Errors {
+		var retErr *ReturnError
+		switch {
+		case want[i] == "returned" && !errors.As(err, &retErr):
+			t.Errorf("message %d: got %v, want a ReturnError", i, err)
+		case want[i] == "nacked" && !errors.Is(err, ErrNacked):
+			t.Errorf("message %d: got %v, want ErrNacked", i, err)
+		case want[i] == "" && err != nil:
+			t.Errorf("message %d: got %v, want nil", i, err)
+		}
+	}
+}
+
+func TestMemoryBrokerPublishBatch(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	declareMoves(t, b)
+	deliveries := consume(t, b, "moves")
+
+	err := b.PublishBatch(context.Background(), batchMessages("moves.alice", "moves.bob", "nowhere", "moves.carol"))
+	checkBatchError(t, err, 4, []int{2}, nil)
+	var batchErr *BatchError
+	errors.As(err, &batchErr)
+	if !reflect.DeepEqual(batchErr.Failed(), []int{2}) {
+		t.Errorf("failed %v, want [2]", batchErr.Failed())
+	}
+	if !strings.Contains(err.Error(), "1 of 4 messages in batch failed, first #2") {
+		t.Errorf("error %q", err)
+	}
+	var retErr *ReturnError
+	if !errors.As(err, &retErr) || retErr.RoutingKey != "nowhere" {
+		t.Errorf("errors.As found %v, want the return of nowhere", retErr)
+	}
+
+	for _, want := range []string{"moves.alice", "moves.bob", "moves.carol"} {
+		if got := string(receive(t, deliveries).Body); got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+	expectNone(t, deliveries)
+
+	err = b.PublishBatch(context.Background(), batchMessages("moves.alice", "moves.bob"))
+	if err != nil {
+		t.Errorf("whole batch routed, got %v", err)
+	}
+}
+
+func TestPublishBatch(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	declareMoves(t, b)
+	deliveries := consume(t, b, "moves")
+
+	err := PublishBatch(context.Background(), b, ContentTypeJSON, "peril", "moves.alice", []int{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for want := 1; want <= 3; want++ {
+		var got int
+		err := json.Unmarshal(receive(t, deliveries).Body, &got)
+		if err != nil || got != want {
+			t.Errorf("got %d, %v, want %d", got, err, want)
+		}
+	}
+
+	err = PublishBatch(context.Background(), b, ContentTypeJSON, "peril", "nowhere", []int{1, 2})
+	checkBatchError(t, err, 2, []int{0, 1}, nil)
+}
+
+// chunkedBroker records the size of every batch it is sent, and nacks the
+// messages whose body is "nack" as a broker out of resources would.
+type chunkedBroker struct {
+	*MemoryBroker
+
+	mu     sync.Mutex
+	chunks []int
+}
+
+func (b *chunkedBroker) PublishBatch(ctx context.Context, msgs []Message) error {
+	b.mu.Lock()
+	b.chunks = append(b.chunks, len(msgs))
+	b.mu.Unlock()
+	errs := make([]error, len(msgs))
+	for i, msg := range msgs {
+		if string(msg.Publishing.Body) == "nack" {
+			errs[i] = ErrNacked
+			continue
+		}
+		errs[i] = b.MemoryBroker.Publish(ctx, msg.Exchange, msg.Key, msg.Publishing)
+	}
+	return batchResult(errs)
+}
+
+func TestLimitedBrokerPublishBatch(t *testing.T) {
+	inner := &chunkedBroker{MemoryBroker: NewMemoryBroker()}
+	defer inner.Close()
+	declareMoves(t, inner.MemoryBroker)
+	b := LimitPublishes(inner, Limit{Rate: 1000, Burst: 2})
+
+	msgs := batchMessages("moves.alice", "moves.bob", "moves.carol", "nowhere", "moves.dave")
+	msgs[4].Publishing.Body = []byte("nack")
+	err := b.PublishBatch(context.Background(), msgs)
+	checkBatchError(t, err, 5, []int{3}, []int{4})
+	if !reflect.DeepEqual(inner.chunks, []int{2, 2, 1}) {
+		t.Errorf("sent in chunks of %v, want [2 2 1]", inner.chunks)
+	}
+
+	inner.chunks = nil
+	err = b.PublishBatch(context.Background(), batchMessages("moves.alice", "moves.bob", "moves.carol"))
+	if err != nil {
+		t.Errorf("whole batch routed, got %v", err)
+	}
+	if !reflect.DeepEqual(inner.chunks, []int{2, 1}) {
+		t.Errorf("sent in chunks of %v, want [2 1]", inner.chunks)
+	}
+
+	inner.Close()
+	err = b.PublishBatch(context.Background(), batchMessages("moves.alice", "moves.bob", "moves.carol"))
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || len(batchErr.Failed()) != 3 {
+		t.Errorf("closed broker got %v, want every message failed", err)
+	}
+}
@@ -0,0 +1,56 @@
+package pubsub
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Broker is what the pubsub functions need from a message broker.
+// *Connection talks AMQP to RabbitMQ and *MemoryBroker is a pure Go stand-in
+// for tests and offline play. Both speak in amqp types so handlers cannot
+// tell them apart.
+type Broker interface {
+	// DeclareExchange declares a durable exchange of the given kind.
+	DeclareExchange(ctx context.Context, name, kind string) error
+	// DeclareQueue declares a queue, or checks that an existing one was
+	// declared with the same flags.
+	DeclareQueue(ctx context.Context, name string, durable, autoDelete, exclusive bool, args amqp.Table) (amqp.Queue, error)
+	// BindQueue routes messages published to exchange with a matching key
+	// to queueName.
+	BindQueue(ctx context.Context, queueName, key, exchange string) error
+	// Publish sends msg and returns once the broker has taken it. Messages
+	// that cannot be routed to any queue fail with a *ReturnError.
+	Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error
+	// PublishBatch sends every message without waiting for the broker in
+	// between and returns once the broker has taken them all. If some
+	// were not taken the error is a *BatchError saying which.
+	PublishBatch(ctx context.Context, msgs []Message) error
+	// Consume delivers messages from queueName until ctx is done or the
+	// broker is closed, at which point the channel is closed. Deliveries
+	// must be acked or nacked one at a time.
+	Consume(ctx context.Context, queueName string, opts ConsumeOptions) (<-chan amqp.Delivery, error)
+	// Call publishes msg as a request and waits for the reply, which the
+	// server sends to msg.ReplyTo with the same correlation ID.
+	Call(ctx context.Context, exchange, key string, msg amqp.Publishing) (amqp.Delivery, error)
+	Close() error
+}
+
+// ConsumeOptions tune how a broker hands messages to a single consumer.
+type ConsumeOptions struct {
+	// PrefetchCount caps the number of unacknowledged deliveries the
+	// consumer holds at once. Zero means no limit.
+	PrefetchCount int
+	// PrefetchSize caps the total body size of unacknowledged deliveries
+	// in bytes. Zero means no limit. RabbitMQ does not implement it.
+	PrefetchSize int
+	// Arguments returns the consumer arguments, e.g. x-stream-offset. It
+	// is called every time the consumer starts, including when it is
+	// resumed after a reconnect. Nil means none.
+	Arguments func() amqp.Table
+}
+
+var (
+	_ Broker = (*Connection)(nil)
+	_ Broker = (*MemoryBroker)(nil)
+)
@@ -0,0 +1,136 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type codecPayload struct {
+	Name  string
+	Units int
+	Tags  []string
+}
+
+// roundTrip publishes val with contentType and returns what a subscription
+// decodes it to.
+func roundTrip[T any](t *testing.T, contentType string, val T) T {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := perilBroker(t)
+
+	got := make(chan T, 1)
+	sub, err := Subscribe(ctx, b, routing.ExchangePerilTopic, "codec", "codec.*", Durable, func(v T) AckType {
+		got <- v
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	err = Publish(ctx, b, contentType, routing.ExchangePerilTopic, "codec.test", val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case v := <-got:
+		return v
+	case <-time.After(time.Second):
+		t.Fatal("nothing handled")
+	}
+	var zero T
+	return zero
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	want := codecPayload{Name: "alice", Units: 3, Tags: []string{"infantry", "cavalry"}}
+	for _, contentType := range []string{ContentTypeJSON, ContentTypeGob, ContentTypeMsgpack, ContentTypeCBOR} {
+		t.Run(contentType, func(t *testing.T) {
+			got := roundTrip(t, contentType, want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+
+	t.Run(ContentTypeProtobuf, func(t *testing.T) {
+		want := wrapperspb.String("alice")
+		got := roundTrip(t, ContentTypeProtobuf, want)
+		if !proto.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+}
+
+func TestLookupCodecIgnoresParameters(t *testing.T) {
+	c, err := LookupCodec("application/json; charset=utf-8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ContentType() != ContentTypeJSON {
+		t.Errorf("got the %s codec", c.ContentType())
+	}
+	_, err = LookupCodec("text/plain")
+	if !errors.Is(err, ErrUnknownContentType) {
+		t.Errorf("got %v, want ErrUnknownContentType", err)
+	}
+}
+
+func TestUnknownContentTypeDeadLettered(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := perilBroker(t)
+	dlq := consume(t, b, routing.QueuePerilDeadLetter)
+
+	handled := make(chan codecPayload, 1)
+	sub, err := Subscribe(ctx, b, routing.ExchangePerilTopic, "codec", "codec.*", Durable, func(v codecPayload) AckType {
+		handled <- v
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	err = b.Publish(ctx, routing.ExchangePerilTopic, "codec.test", amqp.Publishing{
+		ContentType: "text/plain",
+		Body:        []byte("alice"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := receive(t, dlq)
+	reason, _ := d.Headers[HeaderError].(string)
+	if !strings.Contains(reason, "unknown content type") {
+		t.Errorf("dead-lettered with %s %q", HeaderError, reason)
+	}
+	if d.Headers[HeaderOriginalQueue] != "codec" {
+		t.Errorf("dead-lettered with %s %v", HeaderOriginalQueue, d.Headers[HeaderOriginalQueue])
+	}
+	d.Ack(false)
+	expectNone(t, dlq)
+
+	select {
+	case v := <-handled:
+		t.Errorf("handler got %+v", v)
+	default:
+	}
+	queue, err := b.InspectQueue(ctx, "codec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queue.Messages != 0 {
+		t.Errorf("%d messages left in the queue", queue.Messages)
+	}
+}
@@ -0,0 +1,137 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// defaultConfirmTimeout bounds the wait for a publisher confirm when the
+// caller's context has no deadline of its own.
+const defaultConfirmTimeout = 5 * time.Second
+
+// ErrNacked is returned when the broker negatively acknowledges a publish,
+// meaning it did not take responsibility for the message.
+var ErrNacked = errors.New("pubsub: message nacked by broker")
+
+// ReturnError is returned when a publish could not be routed to any queue
+// and the broker handed the message back.
+type ReturnError struct {
+	Exchange   string
+	RoutingKey string
+	ReplyCode  uint16
+	ReplyText  string
+}
+
+func (e *ReturnError) Error() string {
+	return fmt.Sprintf("pubsub: message to exchange %q with key %q returned: %d %s",
+		e.Exchange, e.RoutingKey, e.ReplyCode, e.ReplyText)
+}
+
+// publisher is a channel in confirm mode that publishes with the mandatory
+// flag set and waits for the broker's verdict on every message.
+type publisher struct {
+	// mu serialises publishes so that a basic.return can be attributed to
+	// the message that is currently waiting for its confirm.
+	mu      sync.Mutex
+	ch      *amqp.Channel
+	returns chan amqp.Return
+}
+
+func newPublisher(conn *amqp.Connection) (*publisher, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	return &publisher{
+		ch:      ch,
+		returns: ch.NotifyReturn(make(chan amqp.Return, 16)),
+	}, nil
+}
+
+func (p *publisher) isClosed() bool {
+	return p.ch.IsClosed()
+}
+
+// publish sends msg and blocks until it is confirmed. The broker delivers a
+// basic.return before the matching basic.ack, so once the confirm arrives
+// any return for this message is already waiting on p.returns.
+func (p *publisher) publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.drainReturns()
+
+	confirm, err := p.ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, true, false, msg)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultConfirmTimeout)
+		defer cancel()
+	}
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return confirmResult(false, err, nil, false)
+	}
+
+	var returned *amqp.Return
+	select {
+	case r, ok := <-p.returns:
+		if ok {
+			returned = &r
+		}
+	default:
+	}
+	return confirmResult(acked, nil, returned, p.isClosed())
+}
+
+// confirmResult maps the broker's verdict on a message to the error its
+// publish fails with: waitErr if the confirm never came, a *ReturnError if
+// the message was returned, amqp.ErrClosed if it was nacked because the
+// channel closed, which says nothing about whether the broker took it, and
+// ErrNacked if the broker refused it.
+func confirmResult(acked bool, waitErr error, returned *amqp.Return, closed bool) error {
+	switch {
+	case waitErr != nil:
+		return fmt.Errorf("pubsub: waiting for publisher confirm: %w", waitErr)
+	case returned != nil:
+		return &ReturnError{
+			Exchange:   returned.Exchange,
+			RoutingKey: returned.RoutingKey,
+			ReplyCode:  returned.ReplyCode,
+			ReplyText:  returned.ReplyText,
+		}
+	case !acked && closed:
+		return amqp.ErrClosed
+	case !acked:
+		return ErrNacked
+	default:
+		return nil
+	}
+}
+
+// drainReturns drops returns left over from publishes that timed out before
+// their confirm arrived.
+func (p *publisher) drainReturns() {
+	for {
+		select {
+		case _, ok := <-p.returns:
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestConfirmResult(t *testing.T) {
+	returned := &amqp.Return{ReplyCode: amqp.NoRoute, ReplyText: "NO_ROUTE", Exchange: "peril_topic", RoutingKey: "nowhere"}
+
+	tests := []struct {
+		name     string
+		acked    bool
+		waitErr  error
+		returned *amqp.Return
+		closed   bool
+		want     error
+	}{
+		{name: "confirmed", acked: true},
+		{name: "nacked", want: ErrNacked},
+		{name: "nacked by the channel closing", closed: true, want: amqp.ErrClosed},
+		{name: "acked after closing", acked: true, closed: true},
+		{name: "returned", acked: true, returned: returned, want: &ReturnError{}},
+		{name: "returned then nacked", returned: returned, want: &ReturnError{}},
+		{name: "no confirm", waitErr: context.DeadlineExceeded, want: context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := confirmResult(tt.acked, tt.waitErr, tt.returned, tt.closed)
+			var retErr *ReturnError
+			switch {
+			case tt.want == nil:
+				if err != nil {
+					t.Errorf("got %v, want nil", err)
+				}
+			case errors.As(tt.want, &retErr):
+				if !errors.As(err, &retErr) {
+					t.Fatalf("got %v, want a *ReturnError", err)
+				}
+				if retErr.ReplyCode != amqp.NoRoute || retErr.Exchange != "peril_topic" || retErr.RoutingKey != "nowhere" {
+					t.Errorf("got %+v", retErr)
+				}
+			case !errors.Is(err, tt.want):
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,615 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	minReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay = 30 * time.Second
+
+	// the defaults amqp.Dial would use
+	defaultHeartbeat   = 10 * time.Second
+	defaultLocale      = "en_US"
+	defaultDialTimeout = 30 * time.Second
+)
+
+var consumerSeq uint64
+
+// ErrConnectionClosed is returned once Close has been called on a Connection.
+var ErrConnectionClosed = errors.New("pubsub: connection closed")
+
+// ErrPrefetchSize is returned by Connection.Consume when asked to limit the
+// prefetch by size, which RabbitMQ does not implement.
+var ErrPrefetchSize = errors.New("pubsub: RabbitMQ does not support a prefetch size, only a prefetch count")
+
+type exchangeDecl struct {
+	name string
+	kind string
+}
+
+type queueDecl struct {
+	name       string
+	durable    bool
+	autoDelete bool
+	exclusive  bool
+	args       amqp.Table
+}
+
+type bindingDecl struct {
+	queue    string
+	key      string
+	exchange string
+}
+
+// Connection is an AMQP connection that heals itself. It watches the
+// underlying connection with NotifyClose and, when the broker goes away,
+// redials with backoff, re-declares every exchange, queue and binding that
+// was registered through it and resumes all consumers and the publishing
+// channel.
+type Connection struct {
+	// dial opens a new connection to the broker after the old one is lost
+	dial func() (*amqp.Connection, error)
+
+	mu        sync.Mutex
+	conn      *amqp.Connection
+	pub       *publisher
+	rpc       *rpcClient
+	ready     chan struct{} // closed while conn is usable
+	exchanges []exchangeDecl
+	queues    []queueDecl
+	bindings  []bindingDecl
+	closed    bool
+	done      chan struct{}
+}
+
+// DialOption configures a connection opened by Dial.
+type DialOption func(*amqp.Config)
+
+// WithHeartbeat sets how often heartbeats are exchanged with the broker.
+func WithHeartbeat(d time.Duration) DialOption {
+	return func(cfg *amqp.Config) {
+		cfg.Heartbeat = d
+	}
+}
+
+// WithVhost connects to vhost instead of the one in the URL.
+func WithVhost(vhost string) DialOption {
+	return func(cfg *amqp.Config) {
+		cfg.Vhost = vhost
+	}
+}
+
+// WithConnectionName names the connection in the management UI.
+func WithConnectionName(name string) DialOption {
+	return func(cfg *amqp.Config) {
+		cfg.Properties.SetClientConnectionName(name)
+	}
+}
+
+// WithTLS sets the TLS configuration used for amqps URLs, e.g. to trust a
+// private CA or present a client certificate.
+func WithTLS(tlsConfig *tls.Config) DialOption {
+	return func(cfg *amqp.Config) {
+		cfg.TLSClientConfig = tlsConfig
+	}
+}
+
+// WithCredentials logs in as username instead of the user in the URL.
+func WithCredentials(username, password string) DialOption {
+	return func(cfg *amqp.Config) {
+		cfg.SASL = []amqp.Authentication{&amqp.PlainAuth{Username: username, Password: password}}
+	}
+}
+
+// WithExternalAuth logs in with SASL EXTERNAL, leaving it to the broker to
+// identify the user, typically from the client certificate given with
+// WithTLS. The broker needs the rabbitmq_auth_mechanism_ssl plugin.
+func WithExternalAuth() DialOption {
+	return func(cfg *amqp.Config) {
+		cfg.SASL = []amqp.Authentication{&amqp.ExternalAuth{}}
+	}
+}
+
+// Dial connects to the broker at url. The first dial is not retried and is
+// bounded by ctx so a wrong URL fails fast; every later connection loss is
+// recovered from in the background until Close is called.
+func Dial(ctx context.Context, url string, opts ...DialOption) (*Connection, error) {
+	config := amqp.Config{
+		Heartbeat:  defaultHeartbeat,
+		Locale:     defaultLocale,
+		Properties: amqp.NewConnectionProperties(),
+	}
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	first := config
+	first.Dial = dialContext(ctx)
+	conn, err := amqp.DialConfig(url, first)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Connection{
+		dial: func() (*amqp.Connection, error) {
+			return amqp.DialConfig(url, config)
+		},
+		conn:  conn,
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	close(c.ready)
+
+	go c.watch(conn)
+	return c, nil
+}
+
+// Close shuts the connection down for good. Consumers see their delivery
+// channels closed and publishes fail with ErrConnectionClosed.
+func (c *Connection) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	conn := c.conn
+	c.conn = nil
+	c.pub = nil
+	c.rpc = nil
+	c.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+// Channel opens a plain channel on the current connection. The channel is
+// not recovered after a reconnect; callers that need that should go through
+// Publish or the Subscribe functions instead.
+func (c *Connection) Channel(ctx context.Context) (*amqp.Channel, error) {
+	conn, err := c.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return conn.Channel()
+}
+
+// DeclareExchange declares a durable exchange and remembers it so it is
+// re-declared after a reconnect.
+func (c *Connection) DeclareExchange(ctx context.Context, name, kind string) error {
+	decl := exchangeDecl{name: name, kind: kind}
+	err := c.withChannel(ctx, func(ch *amqp.Channel) error {
+		return channelDeclarer{ch}.DeclareExchange(ctx, name, kind)
+	})
+	if err != nil {
+		return err
+	}
+	c.rememberExchange(decl)
+	return nil
+}
+
+func (c *Connection) rememberExchange(decl exchangeDecl) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.exchanges {
+		if e == decl {
+			return
+		}
+	}
+	c.exchanges = append(c.exchanges, decl)
+}
+
+// InspectExchange checks that a durable exchange exists without declaring
+// it.
+func (c *Connection) InspectExchange(ctx context.Context, name, kind string) error {
+	return c.withChannel(ctx, func(ch *amqp.Channel) error {
+		return ch.ExchangeDeclarePassive(name, kind, true, false, false, false, nil)
+	})
+}
+
+// InspectQueue checks that a queue exists without declaring it, and returns
+// its message and consumer counts.
+func (c *Connection) InspectQueue(ctx context.Context, name string) (amqp.Queue, error) {
+	var queue amqp.Queue
+	err := c.withChannel(ctx, func(ch *amqp.Channel) error {
+		var err error
+		queue, err = ch.QueueDeclarePassive(name, false, false, false, false, nil)
+		return err
+	})
+	return queue, err
+}
+
+// DeclareQueue declares a queue and remembers it so it is re-declared after
+// a reconnect.
+func (c *Connection) DeclareQueue(ctx context.Context, name string, durable, autoDelete, exclusive bool, args amqp.Table) (amqp.Queue, error) {
+	decl := queueDecl{
+		name:       name,
+		durable:    durable,
+		autoDelete: autoDelete,
+		exclusive:  exclusive,
+		args:       args,
+	}
+	var queue amqp.Queue
+	err := c.withChannel(ctx, func(ch *amqp.Channel) error {
+		var err error
+		queue, err = channelDeclarer{ch}.DeclareQueue(ctx, name, durable, autoDelete, exclusive, args)
+		return err
+	})
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+	c.rememberQueue(decl)
+	return queue, nil
+}
+
+func (c *Connection) rememberQueue(decl queueDecl) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, q := range c.queues {
+		if q.name == decl.name {
+			c.queues[i] = decl
+			return
+		}
+	}
+	c.queues = append(c.queues, decl)
+}
+
+// BindQueue binds a queue to an exchange and remembers the binding so it is
+// re-created after a reconnect.
+func (c *Connection) BindQueue(ctx context.Context, queueName, key, exchange string) error {
+	decl := bindingDecl{queue: queueName, key: key, exchange: exchange}
+	err := c.withChannel(ctx, func(ch *amqp.Channel) error {
+		return channelDeclarer{ch}.BindQueue(ctx, queueName, key, exchange)
+	})
+	if err != nil {
+		return err
+	}
+	c.rememberBinding(decl)
+	return nil
+}
+
+func (c *Connection) rememberBinding(decl bindingDecl) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, b := range c.bindings {
+		if b == decl {
+			return
+		}
+	}
+	c.bindings = append(c.bindings, decl)
+}
+
+// Publish sends msg on the connection's shared publishing channel and waits
+// for the broker to confirm it. Unroutable messages fail with a *ReturnError
+// and nacked ones with ErrNacked. If the channel or connection was lost the
+// publish is retried once on the recovered connection, bounded by ctx.
+func (c *Connection) Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	err := c.publish(ctx, exchange, key, msg)
+	observePublish(exchange, key, err)
+	return err
+}
+
+func (c *Connection) publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	for attempt := 0; ; attempt++ {
+		pub, err := c.publisher(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = pub.publish(ctx, exchange, key, msg)
+		if err == nil || attempt > 0 || !errors.Is(err, amqp.ErrClosed) {
+			return err
+		}
+		c.resetPublisher(pub)
+	}
+}
+
+func (c *Connection) publisher(ctx context.Context) (*publisher, error) {
+	conn, err := c.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pub != nil && !c.pub.isClosed() {
+		return c.pub, nil
+	}
+	pub, err := newPublisher(conn)
+	if err != nil {
+		return nil, err
+	}
+	c.pub = pub
+	return pub, nil
+}
+
+func (c *Connection) resetPublisher(pub *publisher) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pub == pub {
+		c.pub = nil
+	}
+}
+
+// Consume starts a consumer on queueName and returns a delivery channel that
+// outlives reconnects: whenever the underlying consumer goes away it is
+// started again on the recovered connection. When ctx is cancelled the
+// consumer tag is cancelled, prefetched deliveries that were not handed out
+// are requeued and the delivery channel is closed; the AMQP channel itself
+// is only closed once every handed-out delivery has been acked or nacked.
+// The delivery channel is also closed once the Connection is closed.
+func (c *Connection) Consume(ctx context.Context, queueName string, opts ConsumeOptions) (<-chan amqp.Delivery, error) {
+	if opts.PrefetchSize != 0 {
+		// RabbitMQ answers a prefetch size with NOT_IMPLEMENTED and closes
+		// the channel, which would happen again after every reconnect
+		return nil, fmt.Errorf("queue %s: %w", queueName, ErrPrefetchSize)
+	}
+	cons, err := c.startConsumer(ctx, queueName, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan amqp.Delivery)
+	go c.resume(ctx, queueName, cons, out, func() (*consumer, error) {
+		return c.startConsumer(ctx, queueName, opts)
+	})
+	return out, nil
+}
+
+// resume forwards the deliveries of cons to out and, whenever the consumer
+// goes away, starts a new one with start until ctx is done or the
+// Connection is closed. It closes out when it returns.
+func (c *Connection) resume(ctx context.Context, queueName string, cons *consumer, out chan<- amqp.Delivery, start func() (*consumer, error)) {
+	defer close(out)
+	for {
+		if !cons.forward(ctx, out) {
+			return
+		}
+
+		for {
+			if c.isClosed() || ctx.Err() != nil {
+				return
+			}
+			var err error
+			cons, err = start()
+			if err == nil {
+				break
+			}
+			if errors.Is(err, ErrConnectionClosed) {
+				return
+			}
+			logger().Warn("unable to resume consumer", "queue", queueName, "error", err)
+			select {
+			case <-c.done:
+				return
+			case <-ctx.Done():
+				return
+			case <-time.After(minReconnectDelay):
+			}
+		}
+	}
+}
+
+func (c *Connection) startConsumer(ctx context.Context, queueName string, opts ConsumeOptions) (*consumer, error) {
+	conn, err := c.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if opts.PrefetchCount > 0 {
+		err = ch.Qos(opts.PrefetchCount, 0, false)
+		if err != nil {
+			ch.Close()
+			return nil, err
+		}
+	}
+
+	var args amqp.Table
+	if opts.Arguments != nil {
+		args = opts.Arguments()
+	}
+	tag := fmt.Sprintf("peril-%s-%d", queueName, atomic.AddUint64(&consumerSeq, 1))
+	deliveries, err := ch.Consume(queueName, tag, false, false, false, false, args)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	return &consumer{ch: ch, tag: tag, deliveries: deliveries}, nil
+}
+
+func (c *Connection) withChannel(ctx context.Context, fn func(*amqp.Channel) error) error {
+	ch, err := c.Channel(ctx)
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	return fn(ch)
+}
+
+// wait blocks until the connection is usable and returns it.
+func (c *Connection) wait(ctx context.Context) (*amqp.Connection, error) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return nil, ErrConnectionClosed
+		}
+		conn, ready := c.conn, c.ready
+		c.mu.Unlock()
+
+		if conn != nil {
+			return conn, nil
+		}
+		select {
+		case <-ready:
+		case <-c.done:
+			return nil, ErrConnectionClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *Connection) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *Connection) watch(conn *amqp.Connection) {
+	for {
+		amqpErr, ok := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+		if c.isClosed() {
+			return
+		}
+		if ok {
+			logger().Warn("connection to broker lost", "error", amqpErr)
+		} else {
+			logger().Warn("connection to broker lost")
+		}
+
+		c.mu.Lock()
+		c.conn = nil
+		c.pub = nil
+		c.rpc = nil
+		c.ready = make(chan struct{})
+		c.mu.Unlock()
+
+		conn = c.redial()
+		if conn == nil {
+			return
+		}
+	}
+}
+
+// redial reconnects with exponential backoff, restores the registered
+// topology and marks the connection ready. It returns nil if the Connection
+// is closed in the meantime.
+func (c *Connection) redial() *amqp.Connection {
+	delay := minReconnectDelay
+	for {
+		select {
+		case <-c.done:
+			return nil
+		case <-time.After(delay):
+		}
+
+		conn, err := c.dial()
+		if err == nil {
+			err = c.restoreOn(conn)
+			if err == nil {
+				c.mu.Lock()
+				if c.closed {
+					c.mu.Unlock()
+					conn.Close()
+					return nil
+				}
+				c.conn = conn
+				close(c.ready)
+				c.mu.Unlock()
+				logger().Info("reconnected to broker")
+				return conn
+			}
+			conn.Close()
+		}
+
+		logger().Warn("unable to reconnect", "retry_in", delay, "error", err)
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+func (c *Connection) restoreOn(conn *amqp.Connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	return c.restore(context.Background(), channelDeclarer{ch})
+}
+
+// declarer is the part of Broker that restore needs.
+type declarer interface {
+	DeclareExchange(ctx context.Context, name, kind string) error
+	DeclareQueue(ctx context.Context, name string, durable, autoDelete, exclusive bool, args amqp.Table) (amqp.Queue, error)
+	BindQueue(ctx context.Context, queueName, key, exchange string) error
+}
+
+// restore re-declares every registered exchange, queue and binding with d.
+func (c *Connection) restore(ctx context.Context, d declarer) error {
+	c.mu.Lock()
+	exchanges := append([]exchangeDecl(nil), c.exchanges...)
+	queues := append([]queueDecl(nil), c.queues...)
+	bindings := append([]bindingDecl(nil), c.bindings...)
+	c.mu.Unlock()
+
+	for _, e := range exchanges {
+		if err := d.DeclareExchange(ctx, e.name, e.kind); err != nil {
+			return err
+		}
+	}
+	for _, q := range queues {
+		if _, err := d.DeclareQueue(ctx, q.name, q.durable, q.autoDelete, q.exclusive, q.args); err != nil {
+			return err
+		}
+	}
+	for _, b := range bindings {
+		if err := d.BindQueue(ctx, b.queue, b.key, b.exchange); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// channelDeclarer declares on a single AMQP channel.
+type channelDeclarer struct {
+	ch *amqp.Channel
+}
+
+func (d channelDeclarer) DeclareExchange(ctx context.Context, name, kind string) error {
+	return d.ch.ExchangeDeclare(name, kind, true, false, false, false, nil)
+}
+
+func (d channelDeclarer) DeclareQueue(ctx context.Context, name string, durable, autoDelete, exclusive bool, args amqp.Table) (amqp.Queue, error) {
+	return d.ch.QueueDeclare(name, durable, autoDelete, exclusive, false, args)
+}
+
+func (d channelDeclarer) BindQueue(ctx context.Context, queueName, key, exchange string) error {
+	return d.ch.QueueBind(queueName, key, exchange, false, nil)
+}
+
+// dialContext behaves like amqp.DefaultDial but also gives up when ctx is
+// done.
+func dialContext(ctx context.Context) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		dialer := net.Dialer{Timeout: defaultDialTimeout}
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		// amqp clears the deadline once the handshake is done
+		if err := conn.SetDeadline(time.Now().Add(defaultDialTimeout)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
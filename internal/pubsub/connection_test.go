@@ -0,0 +1,197 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// disconnected returns a Connection that has lost its broker, as watch
+// leaves it before redialing.
+func disconnected() *Connection {
+	return &Connection{
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// fakeChannel stands in for the AMQP channel of a consumer. Like the real
+// one it closes the deliveries once the consumer is cancelled.
+type fakeChannel struct {
+	deliveries chan amqp.Delivery
+	cancelled  atomic.Bool
+	closed     atomic.Bool
+}
+
+func newFakeConsumer() (*consumer, *fakeChannel) {
+	ch := &fakeChannel{deliveries: make(chan amqp.Delivery, 1)}
+	return &consumer{ch: ch, tag: "fake", deliveries: ch.deliveries}, ch
+}
+
+func (ch *fakeChannel) Cancel(string, bool) error {
+	if !ch.cancelled.Swap(true) {
+		close(ch.deliveries)
+	}
+	return nil
+}
+
+func (ch *fakeChannel) Close() error {
+	ch.closed.Store(true)
+	return nil
+}
+
+type fakeAcknowledger struct {
+	acks atomic.Int64
+}
+
+func (a *fakeAcknowledger) Ack(uint64, bool) error {
+	a.acks.Add(1)
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(uint64, bool, bool) error { return nil }
+
+func (a *fakeAcknowledger) Reject(uint64, bool) error { return nil }
+
+func TestRestoreRedeclaresTopology(t *testing.T) {
+	ctx := context.Background()
+	c := disconnected()
+	c.rememberExchange(exchangeDecl{name: "peril_topic", kind: amqp.ExchangeTopic})
+	c.rememberQueue(queueDecl{name: "moves", durable: true, args: amqp.Table{"x-max-length": 5}})
+	c.rememberQueue(queueDecl{name: "moves", durable: true})
+	c.rememberBinding(bindingDecl{queue: "moves", key: "army_moves.*", exchange: "peril_topic"})
+	c.rememberBinding(bindingDecl{queue: "moves", key: "army_moves.*", exchange: "peril_topic"})
+	if len(c.queues) != 1 || len(c.bindings) != 1 {
+		t.Fatalf("%d queues and %d bindings remembered, want 1 each", len(c.queues), len(c.bindings))
+	}
+
+	// the broker came back without any of it
+	b := NewMemoryBroker()
+	defer b.Close()
+	err := c.restore(ctx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries := consume(t, b, "moves")
+	publish(t, b, "peril_topic", "army_moves.alice", "move")
+	if d := receive(t, deliveries); string(d.Body) != "move" {
+		t.Errorf("received %q", d.Body)
+	}
+}
+
+func TestResumeConsumerAfterForcedClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := disconnected()
+	first, firstCh := newFakeConsumer()
+	second, secondCh := newFakeConsumer()
+	var starts atomic.Int64
+	out := make(chan amqp.Delivery)
+	go c.resume(ctx, "moves", first, out, func() (*consumer, error) {
+		if starts.Add(1) == 1 {
+			return second, nil
+		}
+		return nil, errors.New("started too often")
+	})
+
+	ack := &fakeAcknowledger{}
+	firstCh.deliveries <- amqp.Delivery{Acknowledger: ack, Body: []byte("before")}
+	d := receive(t, out)
+	if string(d.Body) != "before" {
+		t.Errorf("received %q before the close", d.Body)
+	}
+	d.Ack(false)
+
+	// the broker closes the channel under the consumer
+	close(firstCh.deliveries)
+	secondCh.deliveries <- amqp.Delivery{Acknowledger: ack, Body: []byte("after")}
+	d = receive(t, out)
+	if string(d.Body) != "after" {
+		t.Errorf("received %q after the close", d.Body)
+	}
+	d.Ack(false)
+	if starts.Load() != 1 {
+		t.Errorf("consumer started %d times, want 1", starts.Load())
+	}
+
+	cancel()
+	if _, ok := <-out; ok {
+		t.Fatal("delivery after cancel")
+	}
+	if !secondCh.cancelled.Load() {
+		t.Error("resumed consumer not cancelled")
+	}
+	deadline := time.Now().Add(time.Second)
+	for !secondCh.closed.Load() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !secondCh.closed.Load() {
+		t.Error("resumed consumer's channel not closed")
+	}
+	if ack.acks.Load() != 2 {
+		t.Errorf("%d acks, want 2", ack.acks.Load())
+	}
+}
+
+func TestCloseDuringRedial(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	c := disconnected()
+	dialled := make(chan struct{}, 1)
+	c.dial = func() (*amqp.Connection, error) {
+		select {
+		case dialled <- struct{}{}:
+		default:
+		}
+		return nil, errors.New("connection refused")
+	}
+	redialled := make(chan *amqp.Connection)
+	go func() {
+		redialled <- c.redial()
+	}()
+
+	first, firstCh := newFakeConsumer()
+	out := make(chan amqp.Delivery)
+	go c.resume(context.Background(), "moves", first, out, func() (*consumer, error) {
+		return nil, errors.New("channel not open")
+	})
+	close(firstCh.deliveries)
+
+	select {
+	case <-dialled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("never redialled")
+	}
+	c.Close()
+
+	select {
+	case conn := <-redialled:
+		if conn != nil {
+			t.Error("redial returned a connection after Close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("redial still running after Close")
+	}
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Error("delivery after Close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("consumer still resuming after Close")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines after Close, %d before", n, before)
+	}
+}
@@ -0,0 +1,286 @@
+package pubsub
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DedupStore remembers which messages a subscription has already handled,
+// for WithDeduplication.
+type DedupStore interface {
+	// Seen reports whether key was marked.
+	Seen(key string) (bool, error)
+	// Mark records key as handled.
+	Mark(key string) error
+}
+
+// WithDeduplication acks messages whose ID store has already seen on this
+// queue without calling the handler again. A message is marked once the
+// handler answers Ack; messages discarded, requeued or retried are handled
+// again, so one replayed from the dead letter queue reaches the handler.
+// A duplicate delivered while the original is still being handled, e.g. by
+// another worker, waits for it to finish first. Messages without an ID are
+// always handled.
+func WithDeduplication(store DedupStore) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.dedup = store
+	}
+}
+
+// deduplicate wraps handler so messages already marked in store are acked
+// without reaching it. The key includes the queue since the same message
+// can be routed to several queues sharing a store.
+func deduplicate[T any](store DedupStore, queueName string, handler deliveryHandler[T]) deliveryHandler[T] {
+	claims := &dedupClaims{keys: map[string]chan struct{}{}}
+	return func(ctx context.Context, message amqp.Delivery, payload T) AckType {
+		if message.MessageId == "" {
+			return handler(ctx, message, payload)
+		}
+		key := queueName + "/" + message.MessageId
+		// without the claim two workers could both find key unmarked
+		release := claims.claim(key)
+		defer release()
+
+		seen, err := store.Seen(key)
+		if err != nil {
+			// handling a message twice beats not handling it at all
+			logger().Warn("unable to check message for duplicates", append(deliveryAttrs(queueName, message), "error", err)...)
+		}
+		if seen {
+			logger().Info("message was already handled, acking it", deliveryAttrs(queueName, message)...)
+			return Ack
+		}
+
+		ackType := handler(ctx, message, payload)
+		if ackType == Ack {
+			err := store.Mark(key)
+			if err != nil {
+				logger().Warn("unable to mark message as handled", append(deliveryAttrs(queueName, message), "error", err)...)
+			}
+		}
+		return ackType
+	}
+}
+
+// dedupClaims tells the workers of a subscription which messages one of
+// them is handling.
+type dedupClaims struct {
+	mu   sync.Mutex
+	keys map[string]chan struct{}
+}
+
+// claim waits until no other worker holds key, takes it and returns the
+// function that gives it back.
+func (c *dedupClaims) claim(key string) (release func()) {
+	for {
+		c.mu.Lock()
+		held, ok := c.keys[key]
+		if !ok {
+			done := make(chan struct{})
+			c.keys[key] = done
+			c.mu.Unlock()
+			return func() {
+				c.mu.Lock()
+				delete(c.keys, key)
+				c.mu.Unlock()
+				close(done)
+			}
+		}
+		c.mu.Unlock()
+		<-held
+	}
+}
+
+// MemoryDedupStore keeps the most recently marked keys in memory, forgetting
+// the least recently used one when it is full.
+type MemoryDedupStore struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	keys  map[string]*list.Element
+}
+
+// NewMemoryDedupStore returns a store remembering up to size keys.
+func NewMemoryDedupStore(size int) *MemoryDedupStore {
+	if size < 1 {
+		size = 1
+	}
+	return &MemoryDedupStore{
+		size:  size,
+		order: list.New(),
+		keys:  map[string]*list.Element{},
+	}
+}
+
+func (s *MemoryDedupStore) Seen(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.keys[key]
+	if ok {
+		s.order.MoveToFront(e)
+	}
+	return ok, nil
+}
+
+func (s *MemoryDedupStore) Mark(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mark(key)
+	return nil
+}
+
+// mark records key and returns the key it evicted, if any. The caller must
+// hold s.mu.
+func (s *MemoryDedupStore) mark(key string) (evicted string) {
+	if e, ok := s.keys[key]; ok {
+		s.order.MoveToFront(e)
+		return ""
+	}
+	s.keys[key] = s.order.PushFront(key)
+	if s.order.Len() <= s.size {
+		return ""
+	}
+	oldest := s.order.Back()
+	s.order.Remove(oldest)
+	evicted = oldest.Value.(string)
+	delete(s.keys, evicted)
+	return evicted
+}
+
+// FileDedupStore is a MemoryDedupStore that also appends every marked key
+// to a file, so a restarted consumer still recognises messages it handled
+// before. The file is compacted to the keys still remembered once it holds
+// twice as many.
+type FileDedupStore struct {
+	mem  *MemoryDedupStore
+	path string
+
+	mu    sync.Mutex
+	file  *os.File
+	lines int
+}
+
+// OpenFileDedupStore opens the store kept in path, creating it if needed,
+// and loads the last size keys from it.
+func OpenFileDedupStore(path string, size int) (*FileDedupStore, error) {
+	s := &FileDedupStore{
+		mem:  NewMemoryDedupStore(size),
+		path: path,
+	}
+
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if key := scanner.Text(); key != "" {
+				s.mem.mark(key)
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("pubsub: reading dedup store %s: %w", path, err)
+		}
+	}
+
+	err = s.compact()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileDedupStore) Seen(key string) (bool, error) {
+	return s.mem.Seen(key)
+}
+
+func (s *FileDedupStore) Mark(key string) error {
+	s.mem.Mark(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	_, err := fmt.Fprintln(s.file, key)
+	if err != nil {
+		return err
+	}
+	s.lines++
+	if s.lines > 2*s.mem.size {
+		return s.compactLocked()
+	}
+	return nil
+}
+
+// Close closes the store's file. Keys marked afterwards are only kept in
+// memory.
+func (s *FileDedupStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+func (s *FileDedupStore) compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compactLocked()
+}
+
+// compactLocked rewrites the file with just the remembered keys, oldest
+// first, and reopens it for appending. The caller must hold s.mu.
+func (s *FileDedupStore) compactLocked() error {
+	s.mem.mu.Lock()
+	keys := make([]string, 0, s.mem.order.Len())
+	for e := s.mem.order.Back(); e != nil; e = e.Prev() {
+		keys = append(keys, e.Value.(string))
+	}
+	s.mem.mu.Unlock()
+
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, key := range keys {
+		fmt.Fprintln(w, key)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		return err
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	s.lines = len(keys)
+	return nil
+}
@@ -0,0 +1,156 @@
+package pubsub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestDeduplicateMarksOnlyAcked(t *testing.T) {
+	store := NewMemoryDedupStore(10)
+	answers := []AckType{NackRequeue, RetryLater, NackDiscard, Ack}
+	handled := 0
+	handler := deduplicate(store, "moves", func(context.Context, amqp.Delivery, string) AckType {
+		handled++
+		return answers[handled-1]
+	})
+
+	message := amqp.Delivery{MessageId: "move-1"}
+	for i, want := range answers {
+		if got := handler(context.Background(), message, ""); got != want {
+			t.Fatalf("delivery %d answered %s, want %s", i, got, want)
+		}
+	}
+	if got := handler(context.Background(), message, ""); got != Ack {
+		t.Errorf("duplicate answered %s, want Ack", got)
+	}
+	if handled != len(answers) {
+		t.Errorf("handler called %d times, want %d", handled, len(answers))
+	}
+	if seen, _ := store.Seen("moves/move-1"); !seen {
+		t.Error("acked message not marked under its queue")
+	}
+
+	handled = 0
+	answers = []AckType{Ack, Ack}
+	handler(context.Background(), amqp.Delivery{}, "")
+	handler(context.Background(), amqp.Delivery{}, "")
+	if handled != 2 {
+		t.Errorf("message without an ID handled %d times, want 2", handled)
+	}
+}
+
+func TestDeduplicateConcurrentDuplicates(t *testing.T) {
+	var handled atomic.Int64
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := deduplicate(NewMemoryDedupStore(10), "moves", func(context.Context, amqp.Delivery, string) AckType {
+		if handled.Add(1) == 1 {
+			close(started)
+			<-release
+		}
+		return Ack
+	})
+
+	message := amqp.Delivery{MessageId: "move-1"}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		handler(context.Background(), message, "")
+	}()
+	<-started
+	go func() {
+		defer wg.Done()
+		handler(context.Background(), message, "")
+	}()
+	// let the duplicate reach the store while the original is in flight
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if handled.Load() != 1 {
+		t.Errorf("handler called %d times, want 1", handled.Load())
+	}
+}
+
+func TestMemoryDedupStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	s := NewMemoryDedupStore(2)
+	s.Mark("a")
+	s.Mark("b")
+	s.Seen("a")
+	s.Mark("c")
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if seen, _ := s.Seen(key); seen != want {
+			t.Errorf("%s seen = %v, want %v", key, seen, want)
+		}
+	}
+}
+
+func TestFileDedupStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+	s, err := OpenFileDedupStore(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		err := s.Mark(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenFileDedupStore(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for key, want := range map[string]bool{"a": false, "b": true, "c": true, "d": true} {
+		if seen, _ := s.Seen(key); seen != want {
+			t.Errorf("%s seen = %v after reopening, want %v", key, seen, want)
+		}
+	}
+}
+
+func TestFileDedupStoreCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+	s, err := OpenFileDedupStore(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	lines := func() []string {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Fields(string(data))
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		s.Mark(key)
+	}
+	if got := lines(); len(got) != 4 {
+		t.Fatalf("file holds %v before reaching twice the size", got)
+	}
+	s.Mark("e")
+	if got := lines(); strings.Join(got, " ") != "d e" {
+		t.Errorf("file holds %v after compacting, want [d e]", got)
+	}
+	s.Mark("f")
+	if got := lines(); strings.Join(got, " ") != "d e f" {
+		t.Errorf("file holds %v after appending to the compacted file", got)
+	}
+}
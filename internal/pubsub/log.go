@@ -0,0 +1,37 @@
+package pubsub
+
+import (
+	"log/slog"
+	"sync/atomic"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var pkgLogger atomic.Pointer[slog.Logger]
+
+// SetLogger sets the logger pubsub logs to. Until it is called pubsub logs
+// to slog.Default().
+func SetLogger(l *slog.Logger) {
+	pkgLogger.Store(l)
+}
+
+func logger() *slog.Logger {
+	if l := pkgLogger.Load(); l != nil {
+		return l
+	}
+	return slog.Default()
+}
+
+// deliveryAttrs are the fields every log line about a delivery carries.
+func deliveryAttrs(queue string, message amqp.Delivery) []any {
+	attrs := []any{
+		"queue", queue,
+		"exchange", message.Exchange,
+		"routing_key", message.RoutingKey,
+		"message_id", message.MessageId,
+	}
+	if sender, ok := message.Headers[HeaderSender].(string); ok {
+		attrs = append(attrs, "username", sender)
+	}
+	return attrs
+}
@@ -0,0 +1,674 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MemoryBroker is a Broker that lives entirely in the current process. It
+// supports direct, fanout and topic exchanges (with * and # wildcards), the
+// default exchange, durable and transient queues, ack/nack/requeue,
+// x-message-ttl, x-max-length with its x-overflow policies,
+// dead-lettering through the x-dead-letter-exchange queue argument and
+// streams read from an x-stream-offset, so handler code can be exercised
+// without a running RabbitMQ.
+type MemoryBroker struct {
+	mu        sync.Mutex
+	exchanges map[string]*memExchange
+	queues    map[string]*memQueue
+	nextTag   uint64
+	nextName  uint64
+	nextMsg   uint64
+	closed    bool
+	done      chan struct{}
+
+	// replies are the callers waiting in Call, by reply-to address
+	replies map[string]chan amqp.Delivery
+}
+
+type memExchange struct {
+	kind     string
+	bindings []memBinding
+}
+
+type memBinding struct {
+	queue string
+	key   string
+}
+
+type memQueue struct {
+	name       string
+	durable    bool
+	autoDelete bool
+	exclusive  bool
+	args       amqp.Table
+	ready      []memMessage
+	// log holds every message of a stream, at the index of its offset;
+	// streams have no ready messages
+	stream    bool
+	log       []memMessage
+	unacked   map[uint64]memDelivery
+	consumers int
+	deleted   bool
+	// wake is closed and replaced every time a message becomes ready or a
+	// delivery is settled
+	wake chan struct{}
+}
+
+type memMessage struct {
+	id          uint64
+	exchange    string
+	key         string
+	msg         amqp.Publishing
+	redelivered bool
+	// at is when the message was enqueued, for timestamp stream offsets
+	at time.Time
+}
+
+// memDelivery is a message handed to a consumer and not yet settled.
+type memDelivery struct {
+	memMessage
+	consumer *memConsumer
+}
+
+type memConsumer struct {
+	tag  string
+	opts ConsumeOptions
+	// offset is the next message a stream consumer reads
+	offset       int
+	unacked      int
+	unackedBytes int
+}
+
+// full reports whether taking m would exceed the consumer's prefetch
+// limits. A consumer holding nothing is never full, so oversized messages
+// still get through.
+func (c *memConsumer) full(m memMessage) bool {
+	if c.unacked == 0 {
+		return false
+	}
+	if c.opts.PrefetchCount > 0 && c.unacked >= c.opts.PrefetchCount {
+		return true
+	}
+	return c.opts.PrefetchSize > 0 && c.unackedBytes+len(m.msg.Body) > c.opts.PrefetchSize
+}
+
+// NewMemoryBroker returns an empty broker that only knows the default
+// exchange. Like a fresh RabbitMQ, every other exchange has to be declared
+// before it is used.
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		exchanges: map[string]*memExchange{
+			"": {kind: amqp.ExchangeDirect},
+		},
+		queues: map[string]*memQueue{},
+		done:   make(chan struct{}),
+	}
+}
+
+func (b *MemoryBroker) DeclareExchange(ctx context.Context, name, kind string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.check(ctx); err != nil {
+		return err
+	}
+
+	switch kind {
+	case amqp.ExchangeDirect, amqp.ExchangeFanout, amqp.ExchangeTopic:
+	default:
+		return &amqp.Error{Code: amqp.NotImplemented, Reason: fmt.Sprintf("NOT_IMPLEMENTED - exchange type '%s'", kind)}
+	}
+
+	if ex, ok := b.exchanges[name]; ok {
+		if ex.kind != kind {
+			return &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg 'type' for exchange '%s'", name)}
+		}
+		return nil
+	}
+	b.exchanges[name] = &memExchange{kind: kind}
+	return nil
+}
+
+func (b *MemoryBroker) InspectExchange(ctx context.Context, name, kind string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.check(ctx); err != nil {
+		return err
+	}
+	if _, ok := b.exchanges[name]; !ok {
+		return notFound("exchange", name)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) InspectQueue(ctx context.Context, name string) (amqp.Queue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.check(ctx); err != nil {
+		return amqp.Queue{}, err
+	}
+	q, ok := b.queues[name]
+	if !ok {
+		return amqp.Queue{}, notFound("queue", name)
+	}
+	return amqp.Queue{Name: name, Messages: q.messages(), Consumers: q.consumers}, nil
+}
+
+func (b *MemoryBroker) DeclareQueue(ctx context.Context, name string, durable, autoDelete, exclusive bool, args amqp.Table) (amqp.Queue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.check(ctx); err != nil {
+		return amqp.Queue{}, err
+	}
+
+	if name == "" {
+		b.nextName++
+		name = fmt.Sprintf("amq.gen-%d", b.nextName)
+	}
+
+	if q, ok := b.queues[name]; ok {
+		if q.durable != durable || q.autoDelete != autoDelete || q.exclusive != exclusive {
+			return amqp.Queue{}, &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - inequivalent arg for queue '%s'", name)}
+		}
+		return amqp.Queue{Name: name, Messages: q.messages(), Consumers: q.consumers}, nil
+	}
+
+	b.queues[name] = &memQueue{
+		name:       name,
+		durable:    durable,
+		autoDelete: autoDelete,
+		exclusive:  exclusive,
+		args:       args,
+		stream:     args["x-queue-type"] == string(routing.QueueStream),
+		unacked:    map[uint64]memDelivery{},
+		wake:       make(chan struct{}),
+	}
+	return amqp.Queue{Name: name}, nil
+}
+
+func (b *MemoryBroker) BindQueue(ctx context.Context, queueName, key, exchange string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.check(ctx); err != nil {
+		return err
+	}
+
+	ex, ok := b.exchanges[exchange]
+	if !ok || exchange == "" {
+		return notFound("exchange", exchange)
+	}
+	if _, ok := b.queues[queueName]; !ok {
+		return notFound("queue", queueName)
+	}
+
+	binding := memBinding{queue: queueName, key: key}
+	for _, existing := range ex.bindings {
+		if existing == binding {
+			return nil
+		}
+	}
+	ex.bindings = append(ex.bindings, binding)
+	return nil
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	err := b.publish(ctx, exchange, key, msg)
+	observePublish(exchange, key, err)
+	return err
+}
+
+func (b *MemoryBroker) publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.check(ctx); err != nil {
+		return err
+	}
+
+	if exchange == "" && b.reply(key, msg) {
+		return nil
+	}
+	queues, err := b.route(exchange, key)
+	if err != nil {
+		return err
+	}
+	if len(queues) == 0 {
+		return &ReturnError{
+			Exchange:   exchange,
+			RoutingKey: key,
+			ReplyCode:  amqp.NoRoute,
+			ReplyText:  "NO_ROUTE",
+		}
+	}
+	for _, q := range queues {
+		b.enqueue(q, memMessage{exchange: exchange, key: key, msg: msg})
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Consume(ctx context.Context, queueName string, opts ConsumeOptions) (<-chan amqp.Delivery, error) {
+	b.mu.Lock()
+	if err := b.check(ctx); err != nil {
+		b.mu.Unlock()
+		return nil, err
+	}
+	q, ok := b.queues[queueName]
+	if !ok {
+		b.mu.Unlock()
+		return nil, notFound("queue", queueName)
+	}
+	var args amqp.Table
+	if opts.Arguments != nil {
+		args = opts.Arguments()
+	}
+	q.consumers++
+	b.nextName++
+	cons := &memConsumer{
+		tag:    fmt.Sprintf("ctag-memory-%d", b.nextName),
+		opts:   opts,
+		offset: q.startOffset(args[HeaderStreamOffset]),
+	}
+	b.mu.Unlock()
+
+	out := make(chan amqp.Delivery)
+	go func() {
+		defer close(out)
+		defer b.cancelConsumer(q)
+		for {
+			d, ok := b.next(ctx, q, cons)
+			if !ok {
+				return
+			}
+			select {
+			case out <- d:
+			case <-ctx.Done():
+				d.Nack(false, true)
+				return
+			case <-b.done:
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// Close stops every consumer. Messages still in queues are dropped with the
+// broker.
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		close(b.done)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) check(ctx context.Context) error {
+	if b.closed {
+		return ErrConnectionClosed
+	}
+	return ctx.Err()
+}
+
+// next blocks until q has a ready message and cons has room for it, moves
+// it to the unacked set and returns it as a delivery.
+func (b *MemoryBroker) next(ctx context.Context, q *memQueue, cons *memConsumer) (amqp.Delivery, bool) {
+	for {
+		b.mu.Lock()
+		if b.closed || q.deleted {
+			b.mu.Unlock()
+			return amqp.Delivery{}, false
+		}
+		if q.stream && cons.offset < len(q.log) && !cons.full(q.log[cons.offset]) {
+			m := q.log[cons.offset]
+			cons.offset++
+			b.nextTag++
+			q.unacked[b.nextTag] = memDelivery{memMessage: m, consumer: cons}
+			cons.unacked++
+			cons.unackedBytes += len(m.msg.Body)
+			d := m.delivery(&memAcknowledger{broker: b, queue: q}, cons.tag, b.nextTag)
+			b.mu.Unlock()
+			return d, true
+		}
+		if len(q.ready) > 0 && !cons.full(q.ready[0]) {
+			m := q.ready[0]
+			q.ready = q.ready[1:]
+			b.nextTag++
+			q.unacked[b.nextTag] = memDelivery{memMessage: m, consumer: cons}
+			cons.unacked++
+			cons.unackedBytes += len(m.msg.Body)
+			d := m.delivery(&memAcknowledger{broker: b, queue: q}, cons.tag, b.nextTag)
+			b.mu.Unlock()
+			return d, true
+		}
+		wake := q.wake
+		b.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return amqp.Delivery{}, false
+		case <-b.done:
+			return amqp.Delivery{}, false
+		}
+	}
+}
+
+func (b *MemoryBroker) cancelConsumer(q *memQueue) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q.consumers--
+	if q.autoDelete && q.consumers == 0 && !q.deleted {
+		b.deleteQueue(q)
+	}
+}
+
+func (b *MemoryBroker) deleteQueue(q *memQueue) {
+	q.deleted = true
+	delete(b.queues, q.name)
+	for _, ex := range b.exchanges {
+		bindings := ex.bindings[:0]
+		for _, binding := range ex.bindings {
+			if binding.queue != q.name {
+				bindings = append(bindings, binding)
+			}
+		}
+		ex.bindings = bindings
+	}
+	q.signal()
+}
+
+// route returns the queues a message published to exchange with key ends up
+// in. The caller must hold b.mu.
+func (b *MemoryBroker) route(exchange, key string) ([]*memQueue, error) {
+	ex, ok := b.exchanges[exchange]
+	if !ok {
+		return nil, notFound("exchange", exchange)
+	}
+	if exchange == "" {
+		if q, ok := b.queues[key]; ok {
+			return []*memQueue{q}, nil
+		}
+		return nil, nil
+	}
+
+	var queues []*memQueue
+	seen := map[string]bool{}
+	for _, binding := range ex.bindings {
+		if seen[binding.queue] || !bindingMatches(ex.kind, binding.key, key) {
+			continue
+		}
+		seen[binding.queue] = true
+		queues = append(queues, b.queues[binding.queue])
+	}
+	return queues, nil
+}
+
+// settle acks or nacks the deliveries identified by tag on q.
+func (b *MemoryBroker) settle(q *memQueue, tag uint64, multiple, ack, requeue bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var tags []uint64
+	if multiple {
+		for t := range q.unacked {
+			if t <= tag {
+				tags = append(tags, t)
+			}
+		}
+	} else if _, ok := q.unacked[tag]; ok {
+		tags = append(tags, tag)
+	}
+	if len(tags) == 0 {
+		if q.deleted {
+			return nil
+		}
+		return &amqp.Error{Code: amqp.PreconditionFailed, Reason: fmt.Sprintf("PRECONDITION_FAILED - unknown delivery tag %d", tag)}
+	}
+
+	for _, t := range tags {
+		d := q.unacked[t]
+		delete(q.unacked, t)
+		d.consumer.unacked--
+		d.consumer.unackedBytes -= len(d.msg.Body)
+		m := d.memMessage
+		switch {
+		case ack || q.deleted || q.stream:
+		case requeue:
+			m.redelivered = true
+			q.ready = append([]memMessage{m}, q.ready...)
+			q.signal()
+		default:
+			b.deadLetter(q, m, "rejected")
+		}
+	}
+	// wake consumers waiting for prefetch room
+	q.signal()
+	return nil
+}
+
+// deadLetter republishes m to the queue's dead letter exchange, if it has
+// one, recording why in the x-death header the way RabbitMQ does. The
+// caller must hold b.mu.
+func (b *MemoryBroker) deadLetter(q *memQueue, m memMessage, reason string) {
+	dlx, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+	key := m.key
+	if dlk, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		key = dlk
+	}
+
+	msg := m.msg
+	msg.Headers = withDeath(msg.Headers, q.name, reason, m.exchange, m.key)
+
+	queues, err := b.route(dlx, key)
+	if err != nil {
+		return
+	}
+	for _, target := range queues {
+		b.enqueue(target, memMessage{exchange: dlx, key: key, msg: msg})
+	}
+}
+
+// enqueue appends m to q and, if q has a message TTL, arranges for it to be
+// dead-lettered with reason "expired" should it still be waiting by then.
+// A queue at its x-max-length makes room, or refuses m, as its x-overflow
+// says. The caller must hold b.mu.
+func (b *MemoryBroker) enqueue(q *memQueue, m memMessage) {
+	m.at = time.Now()
+	if q.stream {
+		headers := amqp.Table{}
+		for k, v := range m.msg.Headers {
+			headers[k] = v
+		}
+		headers[HeaderStreamOffset] = int64(len(q.log))
+		m.msg.Headers = headers
+		q.log = append(q.log, m)
+		q.signal()
+		return
+	}
+
+	if max, ok := q.args["x-max-length"]; ok && int64(len(q.ready)) >= headerInt(max) {
+		switch q.args["x-overflow"] {
+		case string(routing.OverflowRejectPublish):
+			return
+		case string(routing.OverflowRejectPublishDLX):
+			b.deadLetter(q, m, "maxlen")
+			return
+		default:
+			if len(q.ready) > 0 {
+				head := q.ready[0]
+				q.ready = q.ready[1:]
+				b.deadLetter(q, head, "maxlen")
+			}
+		}
+	}
+
+	b.nextMsg++
+	m.id = b.nextMsg
+	q.ready = append(q.ready, m)
+	q.signal()
+
+	if _, ok := q.args["x-message-ttl"]; !ok {
+		return
+	}
+	ttl := time.Duration(headerInt(q.args["x-message-ttl"])) * time.Millisecond
+	time.AfterFunc(ttl, func() {
+		b.expire(q, m.id)
+	})
+}
+
+// expire dead-letters message id if it is still waiting in q.
+func (b *MemoryBroker) expire(q *memQueue, id uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || q.deleted {
+		return
+	}
+	for i, m := range q.ready {
+		if m.id == id {
+			q.ready = append(q.ready[:i], q.ready[i+1:]...)
+			b.deadLetter(q, m, "expired")
+			return
+		}
+	}
+}
+
+// messages counts the ready messages, or for a stream every message kept.
+func (q *memQueue) messages() int {
+	if q.stream {
+		return len(q.log)
+	}
+	return len(q.ready)
+}
+
+// startOffset is the index in a stream's log that a consumer asking for
+// spec starts at. Without chunks, "last" is the last message.
+func (q *memQueue) startOffset(spec any) int {
+	switch v := spec.(type) {
+	case string:
+		switch v {
+		case "first":
+			return 0
+		case "last":
+			return max(len(q.log)-1, 0)
+		}
+	case time.Time:
+		for i, m := range q.log {
+			if !m.at.Before(v) {
+				return i
+			}
+		}
+	case nil:
+	default:
+		return min(max(int(headerInt(v)), 0), len(q.log))
+	}
+	return len(q.log)
+}
+
+func (q *memQueue) signal() {
+	close(q.wake)
+	q.wake = make(chan struct{})
+}
+
+func (m memMessage) delivery(ack amqp.Acknowledger, consumerTag string, deliveryTag uint64) amqp.Delivery {
+	return amqp.Delivery{
+		Acknowledger:    ack,
+		Headers:         m.msg.Headers,
+		ContentType:     m.msg.ContentType,
+		ContentEncoding: m.msg.ContentEncoding,
+		DeliveryMode:    m.msg.DeliveryMode,
+		Priority:        m.msg.Priority,
+		CorrelationId:   m.msg.CorrelationId,
+		ReplyTo:         m.msg.ReplyTo,
+		Expiration:      m.msg.Expiration,
+		MessageId:       m.msg.MessageId,
+		Timestamp:       m.msg.Timestamp,
+		Type:            m.msg.Type,
+		UserId:          m.msg.UserId,
+		AppId:           m.msg.AppId,
+		ConsumerTag:     consumerTag,
+		DeliveryTag:     deliveryTag,
+		Redelivered:     m.redelivered,
+		Exchange:        m.exchange,
+		RoutingKey:      m.key,
+		Body:            m.msg.Body,
+	}
+}
+
+type memAcknowledger struct {
+	broker *MemoryBroker
+	queue  *memQueue
+}
+
+func (a *memAcknowledger) Ack(tag uint64, multiple bool) error {
+	return a.broker.settle(a.queue, tag, multiple, true, false)
+}
+
+func (a *memAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	return a.broker.settle(a.queue, tag, multiple, false, requeue)
+}
+
+func (a *memAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.broker.settle(a.queue, tag, false, false, requeue)
+}
+
+// withDeath returns a copy of headers with a dead-lettering event recorded
+// in x-death: the entry for the same queue and reason is counted up and
+// moved to the front, otherwise a new entry is prepended.
+func withDeath(headers amqp.Table, queue, reason, exchange, key string) amqp.Table {
+	out := amqp.Table{}
+	for k, v := range headers {
+		out[k] = v
+	}
+
+	deaths, _ := out["x-death"].([]interface{})
+	death := amqp.Table{
+		"count":        int64(1),
+		"reason":       reason,
+		"queue":        queue,
+		"time":         time.Now(),
+		"exchange":     exchange,
+		"routing-keys": []interface{}{key},
+	}
+	rest := make([]interface{}, 0, len(deaths))
+	for _, d := range deaths {
+		t, ok := d.(amqp.Table)
+		if ok && t["queue"] == queue && t["reason"] == reason {
+			count, _ := t["count"].(int64)
+			death["count"] = count + 1
+			continue
+		}
+		rest = append(rest, d)
+	}
+	out["x-death"] = append([]interface{}{death}, rest...)
+
+	if _, ok := out["x-first-death-queue"]; !ok {
+		out["x-first-death-queue"] = queue
+		out["x-first-death-reason"] = reason
+		out["x-first-death-exchange"] = exchange
+	}
+	return out
+}
+
+func bindingMatches(kind, bindingKey, key string) bool {
+	switch kind {
+	case amqp.ExchangeFanout:
+		return true
+	case amqp.ExchangeTopic:
+		return routing.Match(bindingKey, key)
+	default:
+		return bindingKey == key
+	}
+}
+
+func notFound(kind, name string) error {
+	return &amqp.Error{Code: amqp.NotFound, Reason: fmt.Sprintf("NOT_FOUND - no %s '%s'", kind, name)}
+}
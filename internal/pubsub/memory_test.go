@@ -0,0 +1,287 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// receive returns the next delivery on deliveries, failing the test if none
+// arrives in time.
+func receive(t *testing.T, deliveries <-chan amqp.Delivery) amqp.Delivery {
+	t.Helper()
+	select {
+	case d, ok := <-deliveries:
+		if !ok {
+			t.Fatal("deliveries closed")
+		}
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("no delivery")
+	}
+	return amqp.Delivery{}
+}
+
+// expectNone fails the test if anything arrives on deliveries for a moment.
+func expectNone(t *testing.T, deliveries <-chan amqp.Delivery) {
+	t.Helper()
+	select {
+	case d, ok := <-deliveries:
+		if ok {
+			t.Fatalf("unexpected delivery %q", d.Body)
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// declare declares a durable queue with args, reachable through the default
+// exchange.
+func declare(t *testing.T, b *MemoryBroker, queue string, args amqp.Table) {
+	t.Helper()
+	_, err := b.DeclareQueue(context.Background(), queue, true, false, false, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// declareBound declares a durable queue with args and binds it to exchange
+// with key.
+func declareBound(t *testing.T, b *MemoryBroker, exchange, queue, key string, args amqp.Table) {
+	t.Helper()
+	declare(t, b, queue, args)
+	err := b.BindQueue(context.Background(), queue, key, exchange)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func consume(t *testing.T, b *MemoryBroker, queue string) <-chan amqp.Delivery {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	deliveries, err := b.Consume(ctx, queue, ConsumeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deliveries
+}
+
+func publish(t *testing.T, b *MemoryBroker, exchange, key, body string) {
+	t.Helper()
+	err := b.Publish(context.Background(), exchange, key, amqp.Publishing{Body: []byte(body)})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// perilBroker returns a memory broker with the Peril topology declared, so
+// subscriptions have a dead letter exchange to reject to.
+func perilBroker(t *testing.T) *MemoryBroker {
+	t.Helper()
+	b := NewMemoryBroker()
+	t.Cleanup(func() { b.Close() })
+	err := DeclareTopology(context.Background(), b, routing.PerilTopology)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestMemoryBrokerFanout(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	err := b.DeclareExchange(context.Background(), "fan", amqp.ExchangeFanout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	declareBound(t, b, "fan", "a", "", nil)
+	declareBound(t, b, "fan", "b", "ignored", nil)
+
+	publish(t, b, "fan", "any.key", "hello")
+
+	for _, queue := range []string{"a", "b"} {
+		d := receive(t, consume(t, b, queue))
+		if string(d.Body) != "hello" || d.RoutingKey != "any.key" {
+			t.Errorf("%s got %q with key %q", queue, d.Body, d.RoutingKey)
+		}
+	}
+}
+
+func TestMemoryBrokerTopic(t *testing.T) {
+	tests := []struct {
+		binding string
+		key     string
+		routed  bool
+	}{
+		{"army_moves.*", "army_moves.alice", true},
+		{"army_moves.*", "army_moves", false},
+		{"army_moves.*", "army_moves.alice.extra", false},
+		{"game_logs.#", "game_logs", true},
+		{"game_logs.#", "game_logs.alice.more", true},
+		{"war.alice", "war.bob", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.binding+" "+tt.key, func(t *testing.T) {
+			b := NewMemoryBroker()
+			defer b.Close()
+			err := b.DeclareExchange(context.Background(), "topic", amqp.ExchangeTopic)
+			if err != nil {
+				t.Fatal(err)
+			}
+			declareBound(t, b, "topic", "q", tt.binding, nil)
+
+			err = b.Publish(context.Background(), "topic", tt.key, amqp.Publishing{Body: []byte("x")})
+			var returned *ReturnError
+			switch {
+			case tt.routed && err != nil:
+				t.Fatalf("publish: %v", err)
+			case !tt.routed && !errors.As(err, &returned):
+				t.Fatalf("publish: got %v, want a return", err)
+			}
+			if tt.routed {
+				receive(t, consume(t, b, "q"))
+			}
+		})
+	}
+}
+
+func TestMemoryBrokerUnknownExchange(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	err := b.Publish(context.Background(), "nope", "key", amqp.Publishing{})
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) || amqpErr.Code != amqp.NotFound {
+		t.Fatalf("got %v, want NOT_FOUND", err)
+	}
+}
+
+func TestMemoryBrokerAck(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	declare(t, b, "q", nil)
+	deliveries := consume(t, b, "q")
+
+	publish(t, b, "", "q", "once")
+	d := receive(t, deliveries)
+	err := d.Ack(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNone(t, deliveries)
+
+	err = d.Ack(false)
+	if err == nil {
+		t.Fatal("acking twice succeeded")
+	}
+}
+
+func TestMemoryBrokerNackRequeue(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	declare(t, b, "q", nil)
+	deliveries := consume(t, b, "q")
+
+	publish(t, b, "", "q", "again")
+	d := receive(t, deliveries)
+	if d.Redelivered {
+		t.Fatal("first delivery marked redelivered")
+	}
+	err := d.Nack(false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d = receive(t, deliveries)
+	if string(d.Body) != "again" || !d.Redelivered {
+		t.Fatalf("got %q redelivered=%v, want the requeued message", d.Body, d.Redelivered)
+	}
+	d.Ack(false)
+}
+
+func TestMemoryBrokerDeadLetter(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	err := b.DeclareExchange(context.Background(), "dlx", amqp.ExchangeFanout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	declareBound(t, b, "dlx", "dead", "", nil)
+	declare(t, b, "q", amqp.Table{"x-dead-letter-exchange": "dlx"})
+	deliveries := consume(t, b, "q")
+
+	publish(t, b, "", "q", "bad")
+	d := receive(t, deliveries)
+	err = d.Nack(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNone(t, deliveries)
+
+	dead := receive(t, consume(t, b, "dead"))
+	if string(dead.Body) != "bad" {
+		t.Fatalf("dead lettered %q", dead.Body)
+	}
+	deaths, _ := dead.Headers["x-death"].([]interface{})
+	if len(deaths) != 1 {
+		t.Fatalf("x-death = %v", dead.Headers["x-death"])
+	}
+	death := deaths[0].(amqp.Table)
+	if death["queue"] != "q" || death["reason"] != "rejected" || death["count"] != int64(1) {
+		t.Errorf("x-death entry = %v", death)
+	}
+}
+
+func TestMemoryBrokerDiscardWithoutDeadLetterExchange(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+	declare(t, b, "q", nil)
+	deliveries := consume(t, b, "q")
+
+	publish(t, b, "", "q", "gone")
+	receive(t, deliveries).Nack(false, false)
+	expectNone(t, deliveries)
+
+	q, err := b.InspectQueue(context.Background(), "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Messages != 0 {
+		t.Errorf("%d messages left", q.Messages)
+	}
+}
+
+func TestMemoryBrokerClose(t *testing.T) {
+	b := NewMemoryBroker()
+	declare(t, b, "q", nil)
+	deliveries := consume(t, b, "q")
+
+	err := b.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case _, ok := <-deliveries:
+		if ok {
+			t.Fatal("delivery after close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("deliveries not closed")
+	}
+
+	err = b.Publish(context.Background(), "", "q", amqp.Publishing{})
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("publish after close: got %v, want ErrConnectionClosed", err)
+	}
+	_, err = b.Consume(context.Background(), "q", ConsumeOptions{})
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("consume after close: got %v, want ErrConnectionClosed", err)
+	}
+	err = b.Close()
+	if err != nil {
+		t.Errorf("second close: %v", err)
+	}
+}
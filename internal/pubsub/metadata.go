@@ -0,0 +1,155 @@
+package pubsub
+
+import (
+	"context"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Headers carrying the metadata Publish stamps on every message, next to
+// the MessageId, Timestamp and AppId properties. Correlation and causation
+// live in headers because the CorrelationId property belongs to Request.
+const (
+	HeaderSender        = "x-peril-sender"
+	HeaderCorrelationID = "x-peril-correlation-id"
+	HeaderCausationID   = "x-peril-causation-id"
+)
+
+// defaultAppID is stamped on messages published without WithAppID.
+const defaultAppID = "peril"
+
+// Metadata describes where a message came from. Every message published
+// while handling a delivery shares the delivery's correlation ID and has
+// the delivery's message ID as its causation ID, so a war can be traced
+// back to the move that started it.
+type Metadata struct {
+	MessageID     string
+	Timestamp     time.Time
+	AppID         string
+	Sender        string
+	CorrelationID string
+	CausationID   string
+}
+
+// Delivery is a decoded message together with its metadata, for handlers
+// subscribed with SubscribeDelivery.
+type Delivery[T any] struct {
+	Metadata
+	Payload     T
+	Exchange    string
+	RoutingKey  string
+	Headers     amqp.Table
+	Redelivered bool
+
+	ctx     context.Context
+	message amqp.Delivery
+}
+
+// Context returns the subscription's context carrying d as the cause of
+// anything published with it.
+func (d Delivery[T]) Context() context.Context {
+	return withCause(d.ctx, d.Metadata)
+}
+
+func newDelivery[T any](ctx context.Context, message amqp.Delivery, payload T) Delivery[T] {
+	return Delivery[T]{
+		Metadata:    metadataFrom(message),
+		Payload:     payload,
+		Exchange:    message.Exchange,
+		RoutingKey:  message.RoutingKey,
+		Headers:     message.Headers,
+		Redelivered: message.Redelivered,
+		ctx:         ctx,
+		message:     message,
+	}
+}
+
+// logAttrs are the log fields for d, without the queue, which a handler
+// does not know.
+func (d Delivery[T]) logAttrs() []any {
+	attrs := []any{
+		"exchange", d.Exchange,
+		"routing_key", d.RoutingKey,
+		"message_id", d.MessageID,
+	}
+	if d.Sender != "" {
+		attrs = append(attrs, "username", d.Sender)
+	}
+	return attrs
+}
+
+func metadataFrom(message amqp.Delivery) Metadata {
+	sender, _ := message.Headers[HeaderSender].(string)
+	correlationID, _ := message.Headers[HeaderCorrelationID].(string)
+	causationID, _ := message.Headers[HeaderCausationID].(string)
+	return Metadata{
+		MessageID:     message.MessageId,
+		Timestamp:     message.Timestamp,
+		AppID:         message.AppId,
+		Sender:        sender,
+		CorrelationID: correlationID,
+		CausationID:   causationID,
+	}
+}
+
+type (
+	senderKey struct{}
+	appIDKey  struct{}
+	causeKey  struct{}
+)
+
+// WithSender returns a copy of ctx that stamps messages published with it
+// as sent by sender, usually the player's username.
+func WithSender(ctx context.Context, sender string) context.Context {
+	return context.WithValue(ctx, senderKey{}, sender)
+}
+
+// WithAppID returns a copy of ctx that stamps messages published with it
+// with appID instead of "peril".
+func WithAppID(ctx context.Context, appID string) context.Context {
+	return context.WithValue(ctx, appIDKey{}, appID)
+}
+
+func withCause(ctx context.Context, cause Metadata) context.Context {
+	return context.WithValue(ctx, causeKey{}, cause)
+}
+
+// stamp fills in the metadata of msg that the caller left empty and adds
+// the trace in ctx. Its headers are copied rather than modified.
+func stamp(ctx context.Context, msg amqp.Publishing) amqp.Publishing {
+	if msg.MessageId == "" {
+		msg.MessageId = newID()
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now().UTC()
+	}
+	if msg.AppId == "" {
+		msg.AppId = defaultAppID
+		if appID, ok := ctx.Value(appIDKey{}).(string); ok {
+			msg.AppId = appID
+		}
+	}
+
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	if sender, ok := ctx.Value(senderKey{}).(string); ok {
+		headers[HeaderSender] = sender
+	}
+	if _, ok := headers[HeaderCorrelationID]; !ok {
+		// a message nothing caused starts a new conversation
+		headers[HeaderCorrelationID] = msg.MessageId
+		if cause, ok := ctx.Value(causeKey{}).(Metadata); ok {
+			headers[HeaderCorrelationID] = cause.CorrelationID
+			if cause.CorrelationID == "" {
+				headers[HeaderCorrelationID] = cause.MessageID
+			}
+			headers[HeaderCausationID] = cause.MessageID
+		}
+	}
+	injectTrace(ctx, headers)
+	msg.Headers = headers
+	return msg
+}
@@ -0,0 +1,135 @@
+package pubsub
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestStamp(t *testing.T) {
+	ctx := WithSender(WithAppID(context.Background(), "peril-client"), "alice")
+	headers := amqp.Table{"x-custom": "kept"}
+	msg := stamp(ctx, amqp.Publishing{Headers: headers})
+
+	if msg.MessageId == "" {
+		t.Error("no message ID")
+	}
+	if msg.Timestamp.IsZero() {
+		t.Error("no timestamp")
+	}
+	if msg.AppId != "peril-client" {
+		t.Errorf("app ID %q", msg.AppId)
+	}
+	if msg.Headers[HeaderSender] != "alice" {
+		t.Errorf("sender %v", msg.Headers[HeaderSender])
+	}
+	if msg.Headers[HeaderCorrelationID] != msg.MessageId {
+		t.Errorf("correlation ID %v, want the message's own ID %s", msg.Headers[HeaderCorrelationID], msg.MessageId)
+	}
+	if _, ok := msg.Headers[HeaderCausationID]; ok {
+		t.Error("causation ID on a message nothing caused")
+	}
+	if msg.Headers["x-custom"] != "kept" {
+		t.Error("header of the caller dropped")
+	}
+	if len(headers) != 1 {
+		t.Error("headers of the caller modified")
+	}
+
+	again := stamp(context.Background(), amqp.Publishing{MessageId: "move-1", AppId: "bot"})
+	if again.MessageId != "move-1" || again.AppId != "bot" {
+		t.Errorf("stamped over the caller's message ID %q and app ID %q", again.MessageId, again.AppId)
+	}
+	if _, ok := again.Headers[HeaderSender]; ok {
+		t.Error("sender stamped without one in ctx")
+	}
+}
+
+func TestCausationChain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := perilBroker(t)
+
+	// alice's move makes bob declare war, which the server logs
+	moves := make(chan Metadata, 1)
+	wars := make(chan Metadata, 1)
+	logs := make(chan Metadata, 1)
+	bob := WithSender(ctx, "bob")
+	sub, err := SubscribeDelivery(bob, b, routing.ExchangePerilTopic, "moves", "army_moves.*", Transient, func(d Delivery[string]) AckType {
+		moves <- d.Metadata
+		err := PublishJSON(d.Context(), b, routing.ExchangePerilTopic, "war.bob", "war")
+		if err != nil {
+			t.Error(err)
+		}
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	server := WithSender(ctx, "server")
+	sub, err = SubscribeDelivery(server, b, routing.ExchangePerilTopic, "wars", "war.*", Transient, func(d Delivery[string]) AckType {
+		wars <- d.Metadata
+		err := PublishJSON(d.Context(), b, routing.ExchangePerilTopic, "log.server", "logged")
+		if err != nil {
+			t.Error(err)
+		}
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	sub, err = SubscribeDelivery(ctx, b, routing.ExchangePerilTopic, "logs", "log.*", Transient, func(d Delivery[string]) AckType {
+		logs <- d.Metadata
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	err = PublishJSON(WithSender(ctx, "alice"), b, routing.ExchangePerilTopic, "army_moves.alice", "move")
+	if err != nil {
+		t.Fatal(err)
+	}
+	move, war, log := receiveMetadata(t, moves), receiveMetadata(t, wars), receiveMetadata(t, logs)
+
+	if move.MessageID == "" || move.Timestamp.IsZero() || move.AppID != defaultAppID {
+		t.Errorf("move stamped with %+v", move)
+	}
+	for _, hop := range []struct {
+		name   string
+		got    Metadata
+		sender string
+		cause  string
+	}{
+		{"move", move, "alice", ""},
+		{"war", war, "bob", move.MessageID},
+		{"log", log, "server", war.MessageID},
+	} {
+		if hop.got.Sender != hop.sender {
+			t.Errorf("%s sent by %q, want %q", hop.name, hop.got.Sender, hop.sender)
+		}
+		if hop.got.CorrelationID != move.MessageID {
+			t.Errorf("%s correlated with %q, want the move's ID %q", hop.name, hop.got.CorrelationID, move.MessageID)
+		}
+		if hop.got.CausationID != hop.cause {
+			t.Errorf("%s caused by %q, want %q", hop.name, hop.got.CausationID, hop.cause)
+		}
+	}
+}
+
+func receiveMetadata(t *testing.T, metadata <-chan Metadata) Metadata {
+	t.Helper()
+	select {
+	case m := <-metadata:
+		return m
+	case <-time.After(time.Second):
+		t.Fatal("nothing handled")
+	}
+	return Metadata{}
+}
@@ -0,0 +1,171 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus collectors for everything published and consumed through
+// pubsub. They count from the start, and are exposed once registered with
+// RegisterMetrics or served with ServeMetrics.
+var (
+	publishedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "published_total",
+		Help:      "Messages published, confirmed or not.",
+	}, []string{"exchange", "routing_key"})
+	confirmedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "confirmed_total",
+		Help:      "Published messages the broker confirmed.",
+	}, []string{"exchange", "routing_key"})
+	returnedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "returned_total",
+		Help:      "Published messages the broker returned because no queue was bound.",
+	}, []string{"exchange", "routing_key"})
+
+	deliveredTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "delivered_total",
+		Help:      "Messages delivered to subscriptions.",
+	}, []string{"queue", "exchange", "routing_key"})
+	ackedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "acked_total",
+		Help:      "Delivered messages the handler acked.",
+	}, []string{"queue", "exchange", "routing_key"})
+	nackedRequeueTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "nacked_requeue_total",
+		Help:      "Delivered messages handed back to their queue.",
+	}, []string{"queue", "exchange", "routing_key"})
+	nackedDiscardTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "nacked_discard_total",
+		Help:      "Delivered messages discarded to the dead letter exchange, including undecodable ones.",
+	}, []string{"queue", "exchange", "routing_key"})
+	retriedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "retried_total",
+		Help:      "Delivered messages sent to a retry queue.",
+	}, []string{"queue", "exchange", "routing_key"})
+	handlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "handler_duration_seconds",
+		Help:      "Time spent in subscription handlers.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"queue", "exchange", "routing_key"})
+	handlersInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "peril",
+		Subsystem: "pubsub",
+		Name:      "handlers_in_flight",
+		Help:      "Messages being handled right now.",
+	}, []string{"queue"})
+)
+
+// RegisterMetrics registers pubsub's collectors with reg.
+func RegisterMetrics(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		publishedTotal,
+		confirmedTotal,
+		returnedTotal,
+		deliveredTotal,
+		ackedTotal,
+		nackedRequeueTotal,
+		nackedDiscardTotal,
+		retriedTotal,
+		handlerDuration,
+		handlersInFlight,
+		quotaExceededTotal,
+	} {
+		err := reg.Register(c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeMetrics serves pubsub's metrics, along with the Go runtime's, on
+// addr at /metrics until ctx is done.
+func ServeMetrics(ctx context.Context, addr string) error {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	err := RegisterMetrics(reg)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logError(err)
+		}
+	}()
+	return nil
+}
+
+// observePublish counts a publish to exchange with key that ended with err.
+func observePublish(exchange, key string, err error) {
+	publishedTotal.WithLabelValues(exchange, key).Inc()
+	var returned *ReturnError
+	switch {
+	case err == nil:
+		confirmedTotal.WithLabelValues(exchange, key).Inc()
+	case errors.As(err, &returned):
+		// the broker confirms returned messages too
+		confirmedTotal.WithLabelValues(exchange, key).Inc()
+		returnedTotal.WithLabelValues(exchange, key).Inc()
+	}
+}
+
+// observeSettled counts a delivery from queue settled with ackType.
+func observeSettled(queue, exchange, key string, ackType AckType) {
+	labels := []string{queue, exchange, key}
+	switch ackType {
+	case Ack:
+		ackedTotal.WithLabelValues(labels...).Inc()
+	case NackRequeue:
+		nackedRequeueTotal.WithLabelValues(labels...).Inc()
+	case NackDiscard:
+		nackedDiscardTotal.WithLabelValues(labels...).Inc()
+	case RetryLater:
+		retriedTotal.WithLabelValues(labels...).Inc()
+	}
+}
@@ -0,0 +1,95 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// counted snapshots a counter so a test can check how much it grew. The
+// collectors are shared by every test, and by every run with -count.
+type counted struct {
+	name   string
+	c      prometheus.Collector
+	before float64
+}
+
+func count(name string, c prometheus.Collector) counted {
+	return counted{name: name, c: c, before: testutil.ToFloat64(c)}
+}
+
+// grew waits until the counter grew by want, since deliveries are settled
+// after the handler returns.
+func (c counted) grew(t *testing.T, want float64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(c.c)-c.before != want && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := testutil.ToFloat64(c.c) - c.before; got != want {
+		t.Errorf("%s grew by %v, want %v", c.name, got, want)
+	}
+}
+
+func TestMetricsCountPublishesAndSettles(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := perilBroker(t)
+
+	sub, err := Subscribe(ctx, b, routing.ExchangePerilTopic, "metered", "metered.*", Durable, func(answer string) AckType {
+		if answer == "discard" {
+			return NackDiscard
+		}
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	for _, answer := range []string{"ack", "discard"} {
+		key := "metered." + answer
+		published := []string{routing.ExchangePerilTopic, key}
+		delivered := []string{"metered", routing.ExchangePerilTopic, key}
+		publishes := count(key+" published_total", publishedTotal.WithLabelValues(published...))
+		confirms := count(key+" confirmed_total", confirmedTotal.WithLabelValues(published...))
+		deliveries := count(key+" delivered_total", deliveredTotal.WithLabelValues(delivered...))
+		acks := count(key+" acked_total", ackedTotal.WithLabelValues(delivered...))
+		discards := count(key+" nacked_discard_total", nackedDiscardTotal.WithLabelValues(delivered...))
+
+		err := PublishJSON(ctx, b, routing.ExchangePerilTopic, key, answer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		publishes.grew(t, 1)
+		confirms.grew(t, 1)
+		deliveries.grew(t, 1)
+		if answer == "discard" {
+			discards.grew(t, 1)
+			acks.grew(t, 0)
+		} else {
+			acks.grew(t, 1)
+			discards.grew(t, 0)
+		}
+	}
+
+	labels := []string{routing.ExchangePerilTopic, "unmetered.nobody"}
+	counters := []counted{
+		count("unroutable published_total", publishedTotal.WithLabelValues(labels...)),
+		count("unroutable confirmed_total", confirmedTotal.WithLabelValues(labels...)),
+		count("unroutable returned_total", returnedTotal.WithLabelValues(labels...)),
+	}
+	var returned *ReturnError
+	err = PublishJSON(ctx, b, routing.ExchangePerilTopic, "unmetered.nobody", "lost")
+	if !errors.As(err, &returned) {
+		t.Fatalf("unroutable publish got %v", err)
+	}
+	for _, c := range counters {
+		c.grew(t, 1)
+	}
+}
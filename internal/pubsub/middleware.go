@@ -0,0 +1,144 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Handler handles a decoded delivery and says how to settle it.
+type Handler[T any] func(Delivery[T]) AckType
+
+// Middleware wraps a Handler with behaviour shared by many subscriptions.
+type Middleware[T any] func(next Handler[T]) Handler[T]
+
+// WithMiddleware wraps the subscription's handler in mw, the first one
+// outermost. The subscription fails to start if T is not the type it
+// decodes messages into.
+func WithMiddleware[T any](mw ...Middleware[T]) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		for _, m := range mw {
+			cfg.middleware = append(cfg.middleware, m)
+		}
+	}
+}
+
+// chain wraps handler in the middleware configured with WithMiddleware.
+func chain[T any](cfg subscribeConfig, handler deliveryHandler[T]) (deliveryHandler[T], error) {
+	if len(cfg.middleware) == 0 {
+		return handler, nil
+	}
+
+	h := Handler[T](func(d Delivery[T]) AckType {
+		return handler(d.ctx, d.message, d.Payload)
+	})
+	for i := len(cfg.middleware) - 1; i >= 0; i-- {
+		m, ok := cfg.middleware[i].(Middleware[T])
+		if !ok {
+			var payload T
+			return nil, fmt.Errorf("pubsub: %T cannot wrap a handler of %T", cfg.middleware[i], payload)
+		}
+		h = m(h)
+	}
+	return func(ctx context.Context, message amqp.Delivery, payload T) AckType {
+		return h(newDelivery(ctx, message, payload))
+	}, nil
+}
+
+// Logging logs every message the handler receives and how it was settled.
+func Logging[T any](next Handler[T]) Handler[T] {
+	return func(d Delivery[T]) AckType {
+		logger().Info("handling message", d.logAttrs()...)
+		ackType := next(d)
+		logger().Info("handled message", append(d.logAttrs(), "ack", ackType.String())...)
+		return ackType
+	}
+}
+
+// Recover turns a panicking handler into a NackDiscard, sending the message
+// to the dead letter exchange instead of crashing the process. Subscriptions
+// recover panics on their own, see WithPanicAck; Recover is for handlers
+// that need other middleware to see the NackDiscard.
+func Recover[T any](next Handler[T]) Handler[T] {
+	return func(d Delivery[T]) (ackType AckType) {
+		defer func() {
+			if r := recover(); r != nil {
+				logger().Error("handler panicked", append(d.logAttrs(), "panic", fmt.Sprint(r), "stack", string(debug.Stack()))...)
+				ackType = NackDiscard
+			}
+		}()
+		return next(d)
+	}
+}
+
+// Timing logs how long the handler took for every message.
+func Timing[T any](next Handler[T]) Handler[T] {
+	return func(d Delivery[T]) AckType {
+		start := time.Now()
+		ackType := next(d)
+		logger().Info("handler timing", append(d.logAttrs(), "duration", time.Since(start))...)
+		return ackType
+	}
+}
+
+// HandlerMetrics counts what the handlers it is passed to with Metrics did.
+// It is safe to share between subscriptions.
+type HandlerMetrics struct {
+	handled   atomic.Uint64
+	acked     atomic.Uint64
+	requeued  atomic.Uint64
+	discarded atomic.Uint64
+	retried   atomic.Uint64
+	busy      atomic.Int64
+}
+
+// HandlerStats is a snapshot of HandlerMetrics.
+type HandlerStats struct {
+	Handled   uint64
+	Acked     uint64
+	Requeued  uint64
+	Discarded uint64
+	Retried   uint64
+	// Busy is the total time spent in handlers.
+	Busy time.Duration
+}
+
+// Stats returns the counts so far.
+func (m *HandlerMetrics) Stats() HandlerStats {
+	return HandlerStats{
+		Handled:   m.handled.Load(),
+		Acked:     m.acked.Load(),
+		Requeued:  m.requeued.Load(),
+		Discarded: m.discarded.Load(),
+		Retried:   m.retried.Load(),
+		Busy:      time.Duration(m.busy.Load()),
+	}
+}
+
+// Metrics returns middleware counting every message in m by how it was
+// settled, and the time spent handling it.
+func Metrics[T any](m *HandlerMetrics) Middleware[T] {
+	return func(next Handler[T]) Handler[T] {
+		return func(d Delivery[T]) AckType {
+			start := time.Now()
+			ackType := next(d)
+			m.busy.Add(int64(time.Since(start)))
+			m.handled.Add(1)
+			switch ackType {
+			case Ack:
+				m.acked.Add(1)
+			case NackRequeue:
+				m.requeued.Add(1)
+			case NackDiscard:
+				m.discarded.Add(1)
+			case RetryLater:
+				m.retried.Add(1)
+			}
+			return ackType
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package pubsub
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// tracing returns middleware appending name to calls around next.
+func tracing(name string, calls *[]string) Middleware[string] {
+	return func(next Handler[string]) Handler[string] {
+		return func(d Delivery[string]) AckType {
+			*calls = append(*calls, name+" before")
+			ackType := next(d)
+			*calls = append(*calls, name+" after")
+			return ackType
+		}
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	cfg := newSubscribeConfig([]SubscribeOption{
+		WithMiddleware(tracing("first", &calls), tracing("second", &calls)),
+		WithMiddleware(tracing("third", &calls)),
+	})
+	handler, err := chain(cfg, func(_ context.Context, message amqp.Delivery, payload string) AckType {
+		calls = append(calls, "handler "+payload+" "+message.RoutingKey)
+		return NackDiscard
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := handler(context.Background(), amqp.Delivery{RoutingKey: "moves.alice"}, "move"); got != NackDiscard {
+		t.Errorf("answered %s, want the handler's NackDiscard", got)
+	}
+	want := []string{
+		"first before", "second before", "third before",
+		"handler move moves.alice",
+		"third after", "second after", "first after",
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("called %v, want %v", calls, want)
+	}
+}
+
+func TestMiddlewareOfOtherType(t *testing.T) {
+	b := perilBroker(t)
+	_, err := Subscribe(context.Background(), b, routing.ExchangePerilTopic, "moves", "moves.*", Transient,
+		func(string) AckType { return Ack },
+		WithMiddleware(Logging[int]),
+	)
+	if err == nil {
+		t.Fatal("subscribed a handler of string with middleware of int")
+	}
+	if !strings.Contains(err.Error(), "cannot wrap a handler of string") {
+		t.Errorf("got %v", err)
+	}
+	if _, err := b.InspectQueue(context.Background(), "moves"); err == nil {
+		t.Error("queue declared for a subscription that failed")
+	}
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	var m HandlerMetrics
+	answers := []AckType{Ack, Ack, NackRequeue, NackDiscard, RetryLater}
+	i := 0
+	handler := Metrics[string](&m)(func(Delivery[string]) AckType {
+		i++
+		return answers[i-1]
+	})
+	for range answers {
+		handler(Delivery[string]{})
+	}
+
+	got := m.Stats()
+	got.Busy = 0
+	want := HandlerStats{Handled: 5, Acked: 2, Requeued: 1, Discarded: 1, Retried: 1}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
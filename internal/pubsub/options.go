@@ -0,0 +1,176 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// SubscribeOption configures a subscription started by Subscribe.
+type SubscribeOption func(*subscribeConfig)
+
+type subscribeConfig struct {
+	consume            ConsumeOptions
+	workers            int
+	orderingKey        func(amqp.Delivery) string
+	deadLetterExchange string
+	maxRedeliveries    int
+	retrySchedule      []time.Duration
+	retryForever       bool
+	queueOptions       routing.QueueOptions
+	// stream is set by SubscribeStream
+	stream   bool
+	dedup    DedupStore
+	panicAck AckType
+	onError  func(error)
+	// middleware holds a Middleware[T] for the T of the subscription
+	middleware []any
+}
+
+func newSubscribeConfig(opts []SubscribeOption) subscribeConfig {
+	cfg := subscribeConfig{
+		workers:            1,
+		deadLetterExchange: routing.ExchangePerilDeadLetter,
+		retrySchedule:      ExponentialBackoff(time.Second, 5),
+		panicAck:           NackDiscard,
+		onError:            logError,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// WithPrefetch limits how many unacknowledged messages, and how many bytes
+// of them, the broker pushes to the subscription at once. Zero means no
+// limit. RabbitMQ does not implement the byte limit, so subscribing with a
+// size other than zero fails on a Connection; only the MemoryBroker
+// honours it.
+func WithPrefetch(count, size int) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.consume.PrefetchCount = count
+		cfg.consume.PrefetchSize = size
+	}
+}
+
+// WithWorkers runs the handler on n goroutines so up to n messages are
+// handled at once. Without WithOrderingKey messages may be handled out of
+// order.
+func WithWorkers(n int) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		if n > 0 {
+			cfg.workers = n
+		}
+	}
+}
+
+// WithOrderingKey keeps messages that share a key in order: all of them are
+// handled one after another by the same worker. Requeued messages go back
+// to the broker and can still overtake each other.
+func WithOrderingKey(key func(amqp.Delivery) string) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.orderingKey = key
+	}
+}
+
+// ByRoutingKey is an ordering key for WithOrderingKey that keeps messages
+// published with the same routing key in order.
+func ByRoutingKey(d amqp.Delivery) string {
+	return d.RoutingKey
+}
+
+// WithDeadLetterExchange sets the exchange that messages which cannot be
+// decoded are sent to. It defaults to peril_dlx. The queue is declared
+// dead-lettering to it too, unless WithQueueOptions names another exchange.
+func WithDeadLetterExchange(exchange string) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.deadLetterExchange = exchange
+	}
+}
+
+// WithQueueOptions declares the subscription's queue with options, e.g. as
+// a quorum queue or with a maximum length. They must match those of any
+// earlier declaration of the queue, such as the server's topology.
+func WithQueueOptions(options routing.QueueOptions) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.queueOptions = options
+	}
+}
+
+// WithMaxRedeliveries caps how often a message the handler answers with
+// NackRequeue is delivered again. Once a message has been redelivered n
+// times it is rejected to the dead letter exchange instead. Zero, the
+// default, requeues forever.
+func WithMaxRedeliveries(n int) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.maxRedeliveries = n
+	}
+}
+
+// WithRetrySchedule sets how long a message the handler answers with
+// RetryLater waits before each new attempt. After len(delays) retries the
+// message is parked instead, unless WithRetryForever is given. The default is ExponentialBackoff(time.Second, 5).
+func WithRetrySchedule(delays ...time.Duration) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.retrySchedule = delays
+	}
+}
+
+// WithRetryForever keeps retrying a message answered with RetryLater once
+// the retry schedule is used up, waiting its last delay every time, instead
+// of parking it. It suits handlers that answer RetryLater for a condition
+// that passes, like a player over quota, rather than for a failure.
+func WithRetryForever() SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.retryForever = true
+	}
+}
+
+// ExponentialBackoff returns a retry schedule of n delays starting at
+// initial and doubling every time.
+func ExponentialBackoff(initial time.Duration, n int) []time.Duration {
+	delays := make([]time.Duration, n)
+	for i := range delays {
+		delays[i] = initial << i
+	}
+	return delays
+}
+
+func logError(err error) {
+	var panicErr *PanicError
+	if errors.As(err, &panicErr) {
+		logger().Error("handler panicked",
+			"queue", panicErr.Queue,
+			"routing_key", panicErr.RoutingKey,
+			"message_id", panicErr.MessageID,
+			"panic", fmt.Sprint(panicErr.Value),
+			"stack", string(panicErr.Stack),
+		)
+		return
+	}
+	logger().Error("subscription error", "error", err)
+}
+
+// WithPanicAck sets how a message is settled when the handler panics on it.
+// The default, NackDiscard, sends it to the dead letter exchange with the
+// panic recorded in its headers; NackRequeue and RetryLater hand it back
+// subject to WithMaxRedeliveries and WithRetrySchedule.
+func WithPanicAck(ackType AckType) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		cfg.panicAck = ackType
+	}
+}
+
+// WithErrorHandler sets the function told about messages the subscription
+// could not hand to its handler or that the handler panicked on, the latter
+// as a *PanicError. By default they are logged.
+func WithErrorHandler(onError func(error)) SubscribeOption {
+	return func(cfg *subscribeConfig) {
+		if onError != nil {
+			cfg.onError = onError
+		}
+	}
+}
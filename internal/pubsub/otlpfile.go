@@ -0,0 +1,263 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strconv"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// otlpFileExporter writes spans in the OTLP JSON encoding, one TracesData
+// object per line, which is what the collector's otlpjsonfile receiver
+// reads. The Go OTLP exporters only speak gRPC and HTTP.
+type otlpFileExporter struct {
+	mu  sync.Mutex
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+var _ sdktrace.SpanExporter = (*otlpFileExporter)(nil)
+
+func newOTLPFileExporter(w io.WriteCloser) *otlpFileExporter {
+	return &otlpFileExporter{w: w, enc: json.NewEncoder(w)}
+}
+
+func (e *otlpFileExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	data := otlpTracesData(spans)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.enc == nil {
+		return nil
+	}
+	return e.enc.Encode(data)
+}
+
+func (e *otlpFileExporter) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.enc == nil {
+		return nil
+	}
+	e.enc = nil
+	return e.w.Close()
+}
+
+// The types below mirror the OTLP protobuf messages with the field names
+// and value encodings the OTLP JSON mapping prescribes: IDs in hex, 64 bit
+// integers as strings and enums as numbers.
+
+type otlpData struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	SchemaURL  string           `json:"schemaUrl,omitempty"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope     otlpScope  `json:"scope"`
+	Spans     []otlpSpan `json:"spans"`
+	SchemaURL string     `json:"schemaUrl,omitempty"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID                string         `json:"traceId"`
+	SpanID                 string         `json:"spanId"`
+	TraceState             string         `json:"traceState,omitempty"`
+	ParentSpanID           string         `json:"parentSpanId,omitempty"`
+	Name                   string         `json:"name"`
+	Kind                   int            `json:"kind"`
+	StartTimeUnixNano      string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano        string         `json:"endTimeUnixNano"`
+	Attributes             []otlpKeyValue `json:"attributes,omitempty"`
+	DroppedAttributesCount int            `json:"droppedAttributesCount,omitempty"`
+	Events                 []otlpEvent    `json:"events,omitempty"`
+	Links                  []otlpLink     `json:"links,omitempty"`
+	Status                 otlpStatus     `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpLink struct {
+	TraceID    string         `json:"traceId"`
+	SpanID     string         `json:"spanId"`
+	TraceState string         `json:"traceState,omitempty"`
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Message string `json:"message,omitempty"`
+	Code    int    `json:"code,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string         `json:"stringValue,omitempty"`
+	BoolValue   *bool           `json:"boolValue,omitempty"`
+	IntValue    *string         `json:"intValue,omitempty"`
+	DoubleValue *float64        `json:"doubleValue,omitempty"`
+	ArrayValue  *otlpArrayValue `json:"arrayValue,omitempty"`
+}
+
+type otlpArrayValue struct {
+	Values []otlpAnyValue `json:"values"`
+}
+
+// otlpTracesData groups spans by resource and instrumentation scope.
+func otlpTracesData(spans []sdktrace.ReadOnlySpan) otlpData {
+	type scopeKey struct{ name, version, schemaURL string }
+	var data otlpData
+	resources := map[attribute.Distinct]int{}
+	scopes := map[attribute.Distinct]map[scopeKey]int{}
+
+	for _, span := range spans {
+		res := span.Resource()
+		resKey := res.Equivalent()
+		ri, ok := resources[resKey]
+		if !ok {
+			ri = len(data.ResourceSpans)
+			resources[resKey] = ri
+			scopes[resKey] = map[scopeKey]int{}
+			data.ResourceSpans = append(data.ResourceSpans, otlpResourceSpans{
+				Resource:  otlpResource{Attributes: otlpAttributes(res.Attributes())},
+				SchemaURL: res.SchemaURL(),
+			})
+		}
+		rs := &data.ResourceSpans[ri]
+
+		scope := span.InstrumentationScope()
+		key := scopeKey{scope.Name, scope.Version, scope.SchemaURL}
+		si, ok := scopes[resKey][key]
+		if !ok {
+			si = len(rs.ScopeSpans)
+			scopes[resKey][key] = si
+			rs.ScopeSpans = append(rs.ScopeSpans, otlpScopeSpans{
+				Scope:     otlpScope{Name: scope.Name, Version: scope.Version},
+				SchemaURL: scope.SchemaURL,
+			})
+		}
+		ss := &rs.ScopeSpans[si]
+		ss.Spans = append(ss.Spans, otlpSpanFrom(span))
+	}
+	return data
+}
+
+func otlpSpanFrom(span sdktrace.ReadOnlySpan) otlpSpan {
+	sc := span.SpanContext()
+	out := otlpSpan{
+		TraceID:                sc.TraceID().String(),
+		SpanID:                 sc.SpanID().String(),
+		TraceState:             sc.TraceState().String(),
+		Name:                   span.Name(),
+		Kind:                   int(span.SpanKind()),
+		StartTimeUnixNano:      strconv.FormatInt(span.StartTime().UnixNano(), 10),
+		EndTimeUnixNano:        strconv.FormatInt(span.EndTime().UnixNano(), 10),
+		Attributes:             otlpAttributes(span.Attributes()),
+		DroppedAttributesCount: span.DroppedAttributes(),
+		Status:                 otlpStatusFrom(span.Status()),
+	}
+	if parent := span.Parent(); parent.HasSpanID() {
+		out.ParentSpanID = parent.SpanID().String()
+	}
+	for _, event := range span.Events() {
+		out.Events = append(out.Events, otlpEvent{
+			TimeUnixNano: strconv.FormatInt(event.Time.UnixNano(), 10),
+			Name:         event.Name,
+			Attributes:   otlpAttributes(event.Attributes),
+		})
+	}
+	for _, link := range span.Links() {
+		out.Links = append(out.Links, otlpLink{
+			TraceID:    link.SpanContext.TraceID().String(),
+			SpanID:     link.SpanContext.SpanID().String(),
+			TraceState: link.SpanContext.TraceState().String(),
+			Attributes: otlpAttributes(link.Attributes),
+		})
+	}
+	return out
+}
+
+// otlpStatusFrom maps a span status to OTLP, whose codes are numbered Unset,
+// Ok, Error where OpenTelemetry Go has Unset, Error, Ok.
+func otlpStatusFrom(status sdktrace.Status) otlpStatus {
+	switch status.Code {
+	case codes.Ok:
+		return otlpStatus{Code: 1}
+	case codes.Error:
+		return otlpStatus{Code: 2, Message: status.Description}
+	default:
+		return otlpStatus{}
+	}
+}
+
+func otlpAttributes(attrs []attribute.KeyValue) []otlpKeyValue {
+	if len(attrs) == 0 {
+		return nil
+	}
+	out := make([]otlpKeyValue, len(attrs))
+	for i, kv := range attrs {
+		out[i] = otlpKeyValue{Key: string(kv.Key), Value: otlpValue(kv.Value)}
+	}
+	return out
+}
+
+func otlpValue(v attribute.Value) otlpAnyValue {
+	switch v.Type() {
+	case attribute.BOOL:
+		b := v.AsBool()
+		return otlpAnyValue{BoolValue: &b}
+	case attribute.INT64:
+		n := strconv.FormatInt(v.AsInt64(), 10)
+		return otlpAnyValue{IntValue: &n}
+	case attribute.FLOAT64:
+		f := v.AsFloat64()
+		return otlpAnyValue{DoubleValue: &f}
+	case attribute.BOOLSLICE:
+		return otlpArray(v.AsBoolSlice(), attribute.BoolValue)
+	case attribute.INT64SLICE:
+		return otlpArray(v.AsInt64Slice(), attribute.Int64Value)
+	case attribute.FLOAT64SLICE:
+		return otlpArray(v.AsFloat64Slice(), attribute.Float64Value)
+	case attribute.STRINGSLICE:
+		return otlpArray(v.AsStringSlice(), attribute.StringValue)
+	default:
+		s := v.Emit()
+		return otlpAnyValue{StringValue: &s}
+	}
+}
+
+func otlpArray[T any](vals []T, value func(T) attribute.Value) otlpAnyValue {
+	arr := &otlpArrayValue{Values: make([]otlpAnyValue, len(vals))}
+	for i, v := range vals {
+		arr.Values[i] = otlpValue(value(v))
+	}
+	return otlpAnyValue{ArrayValue: arr}
+}
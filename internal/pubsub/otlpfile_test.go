@@ -0,0 +1,126 @@
+package pubsub
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+type bufferCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *bufferCloser) Close() error {
+	b.closed = true
+	return nil
+}
+
+// exportedSpan is a consumed delivery that failed: it has a parent, a
+// link, attributes of every kind, an event and an error status.
+func exportedSpan() sdktrace.ReadOnlySpan {
+	traceID := trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36}
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	return tracetest.SpanStub{
+		Name: "moves process",
+		SpanContext: trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    traceID,
+			SpanID:     trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+			TraceFlags: trace.FlagsSampled,
+		}),
+		Parent: trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID: traceID,
+			SpanID:  trace.SpanID{0x53, 0x99, 0x5c, 0x3f, 0x42, 0xcd, 0x8a, 0xd8},
+			Remote:  true,
+		}),
+		SpanKind:  trace.SpanKindConsumer,
+		StartTime: start,
+		EndTime:   start.Add(1500 * time.Microsecond),
+		Attributes: []attribute.KeyValue{
+			attribute.String("messaging.destination.name", "moves"),
+			attribute.Int64("messaging.message.body.size", 42),
+			attribute.Bool("messaging.rabbitmq.redelivered", false),
+			attribute.Float64("peril.load", 0.5),
+			attribute.StringSlice("peril.units", []string{"infantry", "cavalry"}),
+		},
+		Events: []sdktrace.Event{{
+			Name: "exception",
+			Time: start.Add(time.Millisecond),
+			Attributes: []attribute.KeyValue{
+				attribute.String("exception.message", "out of range"),
+			},
+		}},
+		Links: []sdktrace.Link{{
+			SpanContext: trace.NewSpanContext(trace.SpanContextConfig{
+				TraceID: trace.TraceID{0x01},
+				SpanID:  trace.SpanID{0x02},
+			}),
+			Attributes: []attribute.KeyValue{attribute.String("peril.link", "retry")},
+		}},
+		Status:               sdktrace.Status{Code: codes.Error, Description: "handler panicked"},
+		Resource:             resource.NewSchemaless(attribute.String("service.name", "peril-server")),
+		InstrumentationScope: instrumentation.Scope{Name: "github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub", Version: "1.0.0"},
+	}.Snapshot()
+}
+
+func TestOTLPFileExporterGolden(t *testing.T) {
+	var out bufferCloser
+	e := newOTLPFileExporter(&out)
+	err := e.ExportSpans(context.Background(), []sdktrace.ReadOnlySpan{exportedSpan()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !out.closed {
+		t.Error("file not closed on shutdown")
+	}
+
+	golden := filepath.Join("testdata", "otlp-span.golden.json")
+	if *update {
+		err := os.WriteFile(golden, out.Bytes(), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("exported\n%s\nwant\n%s", out.Bytes(), want)
+	}
+
+	// the protobuf JSON mapping reads IDs as base64 rather than the hex
+	// OTLP uses, so this only checks the names and shapes of the fields
+	var data tracepb.TracesData
+	err = protojson.Unmarshal(out.Bytes(), &data)
+	if err != nil {
+		t.Fatalf("not OTLP JSON: %v", err)
+	}
+	span := data.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if span.Kind != tracepb.Span_SPAN_KIND_CONSUMER || span.Status.Code != tracepb.Status_STATUS_CODE_ERROR {
+		t.Errorf("read back kind %s and status %s", span.Kind, span.Status.Code)
+	}
+	if span.EndTimeUnixNano-span.StartTimeUnixNano != uint64(1500*time.Microsecond) {
+		t.Errorf("read back times %d to %d", span.StartTimeUnixNano, span.EndTimeUnixNano)
+	}
+}
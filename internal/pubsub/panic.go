@@ -0,0 +1,42 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// PanicError is reported to the WithErrorHandler callback when a handler
+// panics.
+type PanicError struct {
+	Queue      string
+	MessageID  string
+	RoutingKey string
+	// Value is what the handler panicked with.
+	Value any
+	// Stack is the handler goroutine's stack at the time of the panic.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("pubsub: handler for %s panicked on message %s from %s: %v", e.Queue, e.MessageID, e.RoutingKey, e.Value)
+}
+
+// runHandler calls handler, turning a panic into a *PanicError so one bad
+// message cannot take the whole process down.
+func runHandler[T any](ctx context.Context, queueName string, message amqp.Delivery, payload T, handler deliveryHandler[T]) (ackType AckType, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{
+				Queue:      queueName,
+				MessageID:  message.MessageId,
+				RoutingKey: message.RoutingKey,
+				Value:      r,
+				Stack:      debug.Stack(),
+			}
+		}
+	}()
+	return handler(ctx, message, payload), nil
+}
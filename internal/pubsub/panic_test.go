@@ -0,0 +1,109 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestHandlerPanic(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         []SubscribeOption
+		deadLettered bool
+	}{
+		{name: "default", deadLettered: true},
+		{name: "acked", opts: []SubscribeOption{WithPanicAck(Ack)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			b := perilBroker(t)
+			dlq := consume(t, b, routing.QueuePerilDeadLetter)
+
+			errs := make(chan error, 1)
+			opts := append([]SubscribeOption{WithErrorHandler(func(err error) { errs <- err })}, tt.opts...)
+			sub, err := Subscribe(ctx, b, routing.ExchangePerilTopic, "moves", "moves.*", Durable, func(string) AckType {
+				panic("out of range")
+			}, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+
+			err = b.Publish(ctx, routing.ExchangePerilTopic, "moves.alice", amqp.Publishing{
+				ContentType: ContentTypeJSON,
+				MessageId:   "move-1",
+				Body:        []byte(`"north"`),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case err := <-errs:
+				var panicErr *PanicError
+				if !errors.As(err, &panicErr) {
+					t.Fatalf("error handler got %v, want a *PanicError", err)
+				}
+				if panicErr.Queue != "moves" || panicErr.RoutingKey != "moves.alice" || panicErr.MessageID != "move-1" {
+					t.Errorf("panic reported for %s %s %s", panicErr.Queue, panicErr.RoutingKey, panicErr.MessageID)
+				}
+				if panicErr.Value != "out of range" || len(panicErr.Stack) == 0 {
+					t.Errorf("panic reported with value %v and %d bytes of stack", panicErr.Value, len(panicErr.Stack))
+				}
+			case <-time.After(time.Second):
+				t.Fatal("error handler not called")
+			}
+
+			if !tt.deadLettered {
+				expectNone(t, dlq)
+				waitForMessages(t, b, "moves", 0)
+				return
+			}
+			d := receive(t, dlq)
+			if reason, _ := d.Headers[HeaderError].(string); !strings.Contains(reason, "panicked") {
+				t.Errorf("dead-lettered with %s %q", HeaderError, reason)
+			}
+			if d.MessageId != "move-1" {
+				t.Errorf("dead-lettered message %q", d.MessageId)
+			}
+		})
+	}
+}
+
+func TestHandlerPanicRequeued(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := perilBroker(t)
+
+	handled := make(chan struct{})
+	attempts := 0
+	sub, err := Subscribe(ctx, b, routing.ExchangePerilTopic, "moves", "moves.*", Durable, func(string) AckType {
+		if attempts++; attempts == 1 {
+			panic("flaky")
+		}
+		close(handled)
+		return Ack
+	}, WithPanicAck(NackRequeue), WithErrorHandler(func(error) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	err = PublishJSON(ctx, b, routing.ExchangePerilTopic, "moves.alice", "north")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("message not handed back after the panic")
+	}
+}
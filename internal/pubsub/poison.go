@@ -0,0 +1,194 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Headers pubsub adds to messages it moves around on its own, so tools
+// inspecting the dead letter queue can tell where a message came from and
+// why it ended up there.
+const (
+	HeaderError              = "x-peril-error"
+	HeaderOriginalExchange   = "x-peril-original-exchange"
+	HeaderOriginalRoutingKey = "x-peril-original-routing-key"
+	HeaderOriginalQueue      = "x-peril-original-queue"
+	HeaderRedeliveries       = "x-peril-redeliveries"
+	HeaderRetryAttempt       = "x-peril-retry-attempt"
+)
+
+// settler settles deliveries that need more than a plain ack or nack.
+type settler struct {
+	// ctx is not cancelled when the subscription is, so messages handled
+	// while shutting down can still be moved.
+	ctx    context.Context
+	broker Broker
+	queue  string
+	cfg    subscribeConfig
+	// transient is set when queue is a Transient queue, whose retry
+	// queues must not outlive it
+	transient bool
+
+	// the retry topology is only declared once something is retried
+	retryOnce sync.Once
+	retryErr  error
+}
+
+func newSettler(ctx context.Context, b Broker, queueName string, queueType SimpleQueueType, cfg subscribeConfig) *settler {
+	return &settler{
+		ctx:       context.WithoutCancel(ctx),
+		broker:    b,
+		queue:     queueName,
+		cfg:       cfg,
+		transient: queueType == Transient,
+	}
+}
+
+// reject sends a message that can never be handled to the dead letter
+// exchange with cause recorded in its headers, then acks it. Nacking would
+// dead-letter it too, but without a way to say why.
+//
+// Messages read from a stream are only acked: the stream keeps them, and
+// replaying it would dead-letter them all over again.
+func (s *settler) reject(message amqp.Delivery, cause error) {
+	if s.cfg.stream {
+		logger().Warn("skipping message in stream", append(deliveryAttrs(s.queue, message), "error", cause)...)
+		message.Ack(false)
+		return
+	}
+	logger().Warn("rejecting message to dead letter exchange", append(deliveryAttrs(s.queue, message), "dead_letter_exchange", s.cfg.deadLetterExchange, "error", cause)...)
+
+	msg := publishingFrom(message)
+	msg.Headers = s.withOrigin(message, amqp.Table{HeaderError: cause.Error()})
+	err := s.broker.Publish(s.ctx, s.cfg.deadLetterExchange, message.RoutingKey, msg)
+	if err != nil {
+		logger().Error("unable to dead-letter message, nacking it instead", append(deliveryAttrs(s.queue, message), "error", err)...)
+		message.Nack(false, false)
+		return
+	}
+	message.Ack(false)
+}
+
+// requeue hands a message back to the queue. With a redelivery limit the
+// message is republished to the queue with a counter in its headers, since
+// a plain requeue leaves no trace on the message, and once the limit is
+// reached it is nacked to the dead letter exchange, which records the
+// rejection in x-death.
+func (s *settler) requeue(message amqp.Delivery) {
+	if s.cfg.maxRedeliveries <= 0 {
+		message.Nack(false, true)
+		return
+	}
+
+	if redeliveries(message, s.queue) >= int64(s.cfg.maxRedeliveries) {
+		logger().Warn("message reached its redelivery limit, rejecting it", append(deliveryAttrs(s.queue, message), "max_redeliveries", s.cfg.maxRedeliveries)...)
+		message.Nack(false, false)
+		return
+	}
+
+	msg := publishingFrom(message)
+	msg.Headers = s.withOrigin(message, amqp.Table{
+		HeaderRedeliveries: headerInt(message.Headers[HeaderRedeliveries]) + 1,
+	})
+	err := s.broker.Publish(s.ctx, "", s.queue, msg)
+	if err != nil {
+		logger().Error("unable to republish message, requeueing it instead", append(deliveryAttrs(s.queue, message), "error", err)...)
+		message.Nack(false, true)
+		return
+	}
+	message.Ack(false)
+}
+
+// withOrigin returns a copy of the message headers with extra added and the
+// message's original route recorded, unless an earlier hop already did.
+func (s *settler) withOrigin(message amqp.Delivery, extra amqp.Table) amqp.Table {
+	headers := amqp.Table{}
+	for k, v := range message.Headers {
+		headers[k] = v
+	}
+	if _, ok := headers[HeaderOriginalRoutingKey]; !ok {
+		headers[HeaderOriginalExchange] = message.Exchange
+		headers[HeaderOriginalRoutingKey] = message.RoutingKey
+		headers[HeaderOriginalQueue] = s.queue
+	}
+	for k, v := range extra {
+		headers[k] = v
+	}
+	return headers
+}
+
+// restoreRoute puts back the exchange and routing key a message was first
+// published with if pubsub rerouted it since, so handlers and ordering keys
+// see the same delivery either way.
+func restoreRoute(message amqp.Delivery) amqp.Delivery {
+	key, ok := message.Headers[HeaderOriginalRoutingKey].(string)
+	if !ok {
+		return message
+	}
+	message.RoutingKey = key
+	if exchange, ok := message.Headers[HeaderOriginalExchange].(string); ok {
+		message.Exchange = exchange
+	}
+	return message
+}
+
+// redeliveries counts how often message has been handed back to queue:
+// pubsub's own counter, the dead-letterings from queue recorded in x-death
+// and, for quorum queues, the broker's x-delivery-count.
+func redeliveries(message amqp.Delivery, queue string) int64 {
+	count := headerInt(message.Headers[HeaderRedeliveries])
+	count += headerInt(message.Headers["x-delivery-count"])
+
+	deaths, _ := message.Headers["x-death"].([]interface{})
+	for _, d := range deaths {
+		death, ok := d.(amqp.Table)
+		if ok && death["queue"] == queue {
+			count += headerInt(death["count"])
+		}
+	}
+	return count
+}
+
+func headerInt(v interface{}) int64 {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int8:
+		return int64(n)
+	case int16:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case uint8:
+		return int64(n)
+	case uint16:
+		return int64(n)
+	case uint32:
+		return int64(n)
+	default:
+		return 0
+	}
+}
+
+func publishingFrom(message amqp.Delivery) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         message.Headers,
+		ContentType:     message.ContentType,
+		ContentEncoding: message.ContentEncoding,
+		DeliveryMode:    message.DeliveryMode,
+		Priority:        message.Priority,
+		CorrelationId:   message.CorrelationId,
+		ReplyTo:         message.ReplyTo,
+		Expiration:      message.Expiration,
+		MessageId:       message.MessageId,
+		Timestamp:       message.Timestamp,
+		Type:            message.Type,
+		UserId:          message.UserId,
+		AppId:           message.AppId,
+		Body:            message.Body,
+	}
+}
@@ -0,0 +1,91 @@
+package pubsub
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestUndecodableBodyRejected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := perilBroker(t)
+	dlq := consume(t, b, routing.QueuePerilDeadLetter)
+
+	var handled atomic.Int64
+	sub, err := Subscribe(ctx, b, routing.ExchangePerilTopic, "poison", "poison.*", Durable, func(codecPayload) AckType {
+		handled.Add(1)
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	err = b.Publish(ctx, routing.ExchangePerilTopic, "poison.alice", amqp.Publishing{
+		ContentType: ContentTypeJSON,
+		Body:        []byte("{not json"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := receive(t, dlq)
+	if reason, _ := d.Headers[HeaderError].(string); reason == "" {
+		t.Errorf("dead-lettered without %s", HeaderError)
+	}
+	if d.Headers[HeaderOriginalExchange] != routing.ExchangePerilTopic || d.Headers[HeaderOriginalRoutingKey] != "poison.alice" || d.Headers[HeaderOriginalQueue] != "poison" {
+		t.Errorf("dead-lettered with origin %v %v %v", d.Headers[HeaderOriginalExchange], d.Headers[HeaderOriginalRoutingKey], d.Headers[HeaderOriginalQueue])
+	}
+	if string(d.Body) != "{not json" {
+		t.Errorf("dead-lettered body %q", d.Body)
+	}
+	d.Ack(false)
+	expectNone(t, dlq)
+	if handled.Load() != 0 {
+		t.Errorf("handler called %d times", handled.Load())
+	}
+}
+
+func TestMaxRedeliveries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := perilBroker(t)
+	dlq := consume(t, b, routing.QueuePerilDeadLetter)
+
+	const maxRedeliveries = 2
+	var attempts atomic.Int64
+	sub, err := Subscribe(ctx, b, routing.ExchangePerilTopic, "poison", "poison.*", Durable, func(string) AckType {
+		attempts.Add(1)
+		return NackRequeue
+	}, WithMaxRedeliveries(maxRedeliveries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	err = PublishJSON(ctx, b, routing.ExchangePerilTopic, "poison.alice", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := receive(t, dlq)
+	if got := attempts.Load(); got != maxRedeliveries+1 {
+		t.Errorf("handled %d times, want %d", got, maxRedeliveries+1)
+	}
+	if got := headerInt(d.Headers[HeaderRedeliveries]); got != maxRedeliveries {
+		t.Errorf("dead-lettered with %s %d, want %d", HeaderRedeliveries, got, maxRedeliveries)
+	}
+	deaths, _ := d.Headers["x-death"].([]interface{})
+	if len(deaths) != 1 || deaths[0].(amqp.Table)["reason"] != "rejected" {
+		t.Errorf("dead-lettered with x-death %v", d.Headers["x-death"])
+	}
+	d.Ack(false)
+	expectNone(t, dlq)
+	if got := attempts.Load(); got != maxRedeliveries+1 {
+		t.Errorf("handled %d times after dead-lettering", got)
+	}
+}
@@ -1,15 +1,14 @@
 package pubsub
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
-	"encoding/json"
 	"fmt"
-	"log"
+	"time"
 
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 type SimpleQueueType string
@@ -25,149 +24,292 @@ const (
 	Ack         AckType = iota // automatically becomes 0
 	NackRequeue                // automatically becomes 1
 	NackDiscard                // automatically becomes 2
+	RetryLater                 // redelivered after a backoff delay, see WithRetrySchedule
 )
 
-func PublishJSON[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	jsonBytes, err := json.Marshal(val)
-	if err != nil {
-		fmt.Println("Error:", err)
-		return err
+func (a AckType) String() string {
+	switch a {
+	case Ack:
+		return "Ack"
+	case NackRequeue:
+		return "NackRequeue"
+	case NackDiscard:
+		return "NackDiscard"
+	case RetryLater:
+		return "RetryLater"
+	default:
+		return fmt.Sprintf("AckType(%d)", int(a))
 	}
-	err = ch.PublishWithContext(
-		context.Background(),
-		exchange,
-		key,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        jsonBytes,
-		},
-	)
+}
 
+// Publish encodes val with the codec registered for contentType and
+// publishes it, stamped with a fresh message ID, the time, and the app ID,
+// sender and cause carried by ctx.
+func Publish[T any](ctx context.Context, b Broker, contentType, exchange, key string, val T) error {
+	codec, err := LookupCodec(contentType)
 	if err != nil {
-		fmt.Println("Error:", err)
 		return err
 	}
-	return nil
-}
-
-func PublishGob[T any](ch *amqp.Channel, exchange, key string, val T) error {
-	//encode val T to gob bytes
-	var buffer bytes.Buffer
-	encoder := gob.NewEncoder(&buffer)
-	err := encoder.Encode(val)
-
+	body, err := codec.Marshal(val)
 	if err != nil {
+		logger().Error("unable to encode message", "exchange", exchange, "routing_key", key, "content_type", contentType, "error", err)
 		return err
 	}
 
-	err = ch.PublishWithContext(
-		context.Background(),
+	ctx, span := startPublishSpan(ctx, exchange, key)
+	defer func() { endSpan(span, err) }()
+	err = b.Publish(
+		ctx,
 		exchange,
 		key,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "application/gob",
-			Body:        buffer.Bytes(),
-		},
+		stamp(ctx, amqp.Publishing{
+			ContentType: codec.ContentType(),
+			Body:        body,
+		}),
 	)
-
 	if err != nil {
-		fmt.Println("Error:", err)
+		logger().Error("unable to publish message", "exchange", exchange, "routing_key", key, "error", err)
 		return err
 	}
 	return nil
 }
 
+func PublishJSON[T any](ctx context.Context, b Broker, exchange, key string, val T) error {
+	return Publish(ctx, b, ContentTypeJSON, exchange, key, val)
+}
+
+func PublishGob[T any](ctx context.Context, b Broker, exchange, key string, val T) error {
+	return Publish(ctx, b, ContentTypeGob, exchange, key, val)
+}
+
 // 📌  declareAndBind functionality 📝 🗑️
-func DeclareAndBind(conn *amqp.Connection, exchange, queueName, key string, queueType SimpleQueueType) (*amqp.Channel, amqp.Queue, error) {
-	channel, err := conn.Channel()
+func DeclareAndBind(ctx context.Context, b Broker, exchange, queueName, key string, queueType SimpleQueueType) (amqp.Queue, error) {
+	return DeclareAndBindWithOptions(ctx, b, exchange, queueName, key, queueType, routing.QueueOptions{})
+}
+
+// DeclareAndBindWithOptions is DeclareAndBind for queues that need more
+// than the defaults, e.g. a bounded quorum queue. Queues other than streams
+// dead-letter to peril_dlx unless the options name another exchange.
+func DeclareAndBindWithOptions(ctx context.Context, b Broker, exchange, queueName, key string, queueType SimpleQueueType, options routing.QueueOptions) (amqp.Queue, error) {
+	durable, autoDelete, exclusive := queueType == Durable, queueType == Transient, queueType == Transient
+	err := options.Validate()
+	if err == nil {
+		err = options.CheckDeclare(durable, autoDelete, exclusive)
+	}
 	if err != nil {
-		fmt.Println("unable to get client username...")
-		return nil, amqp.Queue{}, err
+		return amqp.Queue{}, fmt.Errorf("queue %s: %w", queueName, err)
+	}
+	if options.DeadLetterExchange == "" && options.Type != routing.QueueStream {
+		options.DeadLetterExchange = routing.ExchangePerilDeadLetter
 	}
 
 	// 📌  amqpTable config 📝 🗑️
-	table := amqp.Table{}
-	table["x-dead-letter-exchange"] = routing.ExchangePerilDeadLetter
-
-	queue, err := channel.QueueDeclare(
+	queue, err := b.DeclareQueue(
+		ctx,
 		queueName,
-		queueType == Durable,
-		queueType == Transient,
-		queueType == Transient,
-		false, // noWait
-		table,
+		durable,
+		autoDelete,
+		exclusive,
+		queueArgs(options.Table()),
 	)
 	if err != nil {
-		log.Printf("unable to declare Queue ... error: %v\n", err)
-		return nil, amqp.Queue{}, err
+		logger().Error("unable to declare queue", "queue", queueName, "error", err)
+		return amqp.Queue{}, err
 	}
 
-	err = channel.QueueBind(queueName, key, exchange, false, nil)
+	err = b.BindQueue(ctx, queueName, key, exchange)
 	if err != nil {
-		fmt.Println("unable to bind Queue ...")
-		return nil, amqp.Queue{}, err
+		logger().Error("unable to bind queue", "queue", queueName, "exchange", exchange, "routing_key", key, "error", err)
+		return amqp.Queue{}, err
 	}
 
-	return channel, queue, nil
+	return queue, nil
 }
 
-// 📌  subscribeJson functionality 📝 🗑️
-func SubscribeJSON[T any](
-
-	conn *amqp.Connection,
+// Subscribe declares and binds queueName and calls handler with every
+// message delivered to it, decoded with the codec registered for the
+// message's content type. Messages with an unknown content type or a body
+// that does not decode are rejected to the dead letter exchange, with the
+// reason in their headers, without reaching handler.
+func Subscribe[T any](
+	ctx context.Context,
+	b Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType,
 	handler func(T) AckType,
-) error {
-	delivery, err := subscribe[T](
-		conn,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return subscribe(ctx, b, exchange, queueName, key, queueType, func(_ context.Context, _ amqp.Delivery, payload T) AckType {
+		return handler(payload)
+	}, opts...)
+}
+
+// SubscribeDelivery is Subscribe for handlers that need to know more than
+// the payload: who sent it, when, and what caused it. Publishing with the
+// delivery's Context records it as the cause of the new message.
+func SubscribeDelivery[T any](
+	ctx context.Context,
+	b Broker,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler Handler[T],
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return subscribe(ctx, b, exchange, queueName, key, queueType, func(ctx context.Context, message amqp.Delivery, payload T) AckType {
+		return handler(newDelivery(ctx, message, payload))
+	}, opts...)
+}
+
+// deliveryHandler is the handler subscribe runs: it also gets the delivery
+// the payload came in and a context carrying the delivery's trace.
+type deliveryHandler[T any] func(ctx context.Context, message amqp.Delivery, payload T) AckType
+
+// subscribe is Subscribe for handlers that also need the delivery the
+// payload came in.
+func subscribe[T any](
+	ctx context.Context,
+	b Broker,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler deliveryHandler[T],
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	cfg := newSubscribeConfig(opts)
+	if cfg.dedup != nil {
+		handler = deduplicate(cfg.dedup, queueName, handler)
+	}
+	handler, err := chain(cfg, handler)
+	if err != nil {
+		return nil, err
+	}
+
+	queueOptions := cfg.queueOptions
+	if queueOptions.DeadLetterExchange == "" && queueOptions.Type != routing.QueueStream {
+		queueOptions.DeadLetterExchange = cfg.deadLetterExchange
+	}
+	_, err = DeclareAndBindWithOptions(
+		ctx,
+		b,
 		exchange,
 		queueName,
 		key,
 		queueType,
+		queueOptions,
 	)
 	if err != nil {
-		fmt.Println("subscribe process failed ...")
-		return err
+		return nil, err
 	}
 
-	go acknowledgeDelivery(delivery, handler)
-	return nil
+	ctx, cancel := context.WithCancel(ctx)
+	delivery, err := b.Consume(ctx, queueName, cfg.consume)
+	if err != nil {
+		cancel()
+		logger().Error("unable to consume", "queue", queueName, "error", err)
+		return nil, err
+	}
+
+	settle := newSettler(ctx, b, queueName, queueType, cfg)
+	sub := newSubscription(cancel)
+	go func() {
+		runWorkers(delivery, cfg, func(message amqp.Delivery) {
+			acknowledgeDelivery(ctx, settle, message, handler)
+		})
+		sub.finish(nil)
+	}()
+	return sub, nil
+}
+
+// 📌  subscribeJson functionality 📝 🗑️
+// SubscribeJSON predates Subscribe and is kept for its callers; since the
+// codec is picked per message it accepts any registered content type.
+func SubscribeJSON[T any](
+	ctx context.Context,
+	b Broker,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(T) AckType,
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	sub, err := Subscribe(ctx, b, exchange, queueName, key, queueType, handler, opts...)
+	if err != nil {
+		logger().Error("unable to subscribe", "queue", queueName, "error", err)
+		return nil, err
+	}
+	return sub, nil
 }
 
 // 📌  acknowledgeDelivery 📝 🗑️
-func acknowledgeDelivery[T any](delivery <-chan amqp.Delivery, handler func(T) AckType) {
-	for message := range delivery {
-		var payload T
-		err := json.Unmarshal(message.Body, &payload)
-		if err != nil {
-			fmt.Println("unable to unmarshall delivery")
-			fmt.Printf("from ack, err: %v\n", err)
-			return
-		}
-
-		ackType := handler(payload)
-		switch ackType {
-		case Ack:
-			message.Ack(false)
-			fmt.Println("Ack")
-		case NackDiscard:
-			message.Nack(false, false)
-			fmt.Println("NackDiscard")
-		case NackRequeue:
-			message.Nack(false, true)
-			fmt.Println("NackRequeue")
-		}
+func acknowledgeDelivery[T any](ctx context.Context, settle *settler, message amqp.Delivery, handler deliveryHandler[T]) {
+	message = restoreRoute(message)
+	ctx, span := startProcessSpan(ctx, settle.queue, message)
+	defer span.End()
+	deliveredTotal.WithLabelValues(settle.queue, message.Exchange, message.RoutingKey).Inc()
+
+	codec, err := LookupCodec(message.ContentType)
+	if err != nil {
+		settle.cfg.onError(err)
+		span.SetStatus(codes.Error, err.Error())
+		settle.reject(message, err)
+		observeSettled(settle.queue, message.Exchange, message.RoutingKey, NackDiscard)
+		return
+	}
+
+	var payload T
+	err = codec.Unmarshal(message.Body, &payload)
+	if err != nil {
+		settle.cfg.onError(err)
+		span.SetStatus(codes.Error, err.Error())
+		settle.reject(message, err)
+		observeSettled(settle.queue, message.Exchange, message.RoutingKey, NackDiscard)
+		return
+	}
+
+	inFlight := handlersInFlight.WithLabelValues(settle.queue)
+	inFlight.Inc()
+	start := time.Now()
+	ackType, err := runHandler(ctx, settle.queue, message, payload, handler)
+	handlerDuration.WithLabelValues(settle.queue, message.Exchange, message.RoutingKey).Observe(time.Since(start).Seconds())
+	inFlight.Dec()
+	if err != nil {
+		settle.cfg.onError(err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		ackType = settle.cfg.panicAck
+	}
+	span.SetAttributes(attribute.String("peril.ack", ackType.String()))
+	observeSettled(settle.queue, message.Exchange, message.RoutingKey, ackType)
+	logger().Debug("settling message", append(deliveryAttrs(settle.queue, message), "ack", ackType.String())...)
+	if err != nil && ackType == NackDiscard {
+		settle.reject(message, err)
+		return
+	}
+	if settle.cfg.stream {
+		// a stream keeps every message whatever the handler says; the ack
+		// only makes room for the next delivery
+		message.Ack(false)
+		return
+	}
+	switch ackType {
+	case Ack:
+		message.Ack(false)
+	case NackDiscard:
+		message.Nack(false, false)
+	case NackRequeue:
+		settle.requeue(message)
+	case RetryLater:
+		settle.retryLater(message)
 	}
 }
 
-func PublishGameLog(gameLog routing.GameLog, channel *amqp.Channel) error {
+func PublishGameLog(ctx context.Context, gameLog routing.GameLog, b Broker) error {
 	/*this function calls publishGob in order to serialize and
 	publish the gameLog argument to a queue in an exchange with
 	the following values
@@ -177,9 +319,10 @@ func PublishGameLog(gameLog routing.GameLog, channel *amqp.Channel) error {
 	GamelogSlug if a constant in routing package*/
 
 	err := PublishGob(
-		channel,
+		ctx,
+		b,
 		routing.ExchangePerilTopic,
-		routing.GameLogSlug+"."+gameLog.Username,
+		routing.GameLogKey(gameLog.Username),
 		gameLog,
 	)
 
@@ -189,97 +332,22 @@ func PublishGameLog(gameLog routing.GameLog, channel *amqp.Channel) error {
 	return nil
 }
 
+// SubscribeGob predates Subscribe and is kept for its callers; since the
+// codec is picked per message it accepts any registered content type.
 func SubscribeGob[T any](
-	conn *amqp.Connection,
+	ctx context.Context,
+	b Broker,
 	exchange,
 	queueName,
 	key string,
 	queueType SimpleQueueType,
 	handler func(T) AckType,
-) error {
-	/*
-		subscribe Gob would consume(have access to) data sent  to
-		a certain channel. The data that it expects would come in as binary (Gob). That binary
-		would need to be converted (decoded) into the generic type T that is passed into subscribeGob.
-		It then returns an error if the subscribe process fails.
-	*/
-	delivery, err := subscribe[T](
-		conn,
-		exchange,
-		queueName,
-		key,
-		queueType,
-	)
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	sub, err := Subscribe(ctx, b, exchange, queueName, key, queueType, handler, opts...)
 	if err != nil {
-		log.Println("subscribe process failed ...")
-		return err
-	}
-
-	//decode delivery
-	//delivery has to be converted into generic type and then called with handler
-	for message := range delivery {
-		//message would be a binary file. we would need to decode it into a generic and pass it into handler
-		var payload T
-		gameLog, err := decode(message.Body, payload)
-		if err != nil {
-			log.Println("unable to decode bytes")
-			return err
-		}
-		//write to gamelogic.WriteLog
-		ackType := handler(gameLog)
-		if ackType == Ack {
-			message.Ack(true)
-		}
-
-	}
-	return nil
-
-}
-
-func subscribe[T any](
-	conn *amqp.Connection,
-	exchange,
-	queueName,
-	key string,
-	queueType SimpleQueueType,
-) (<-chan amqp.Delivery, error) {
-	channel, _, err := DeclareAndBind(
-		conn,
-		exchange,
-		queueName,
-		key,
-		queueType,
-	)
-	if err != nil {
-		fmt.Println("unable to bind Queue ...")
-		return nil, err
-	}
-
-	delivery, err := channel.Consume(
-		queueName,
-		"",
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		fmt.Println("unable to unmarshall delivery")
-		fmt.Printf("from consume. err: %v\n", err)
+		logger().Error("unable to subscribe", "queue", queueName, "error", err)
 		return nil, err
 	}
-
-	return delivery, nil
-}
-
-func decode[T any](data []byte, gl T) (T, error) {
-
-	buf := bytes.NewBuffer(data)
-	dec := gob.NewDecoder(buf)
-	err := dec.Decode(&gl)
-	if err != nil {
-		return gl, err
-	}
-	return gl, nil
+	return sub, nil
 }
@@ -0,0 +1,211 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"github.com/prometheus/client_golang/prometheus"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"golang.org/x/time/rate"
+)
+
+var quotaExceededTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "peril",
+	Subsystem: "pubsub",
+	Name:      "quota_exceeded_total",
+	Help:      "Delivered messages refused or delayed because their sender was over quota.",
+}, []string{"ack"})
+
+const (
+	// maxQuotaPlayers caps how many players Quota keeps a bucket for.
+	// Routing keys are chosen by publishers, so without a cap made up
+	// usernames would grow the buckets without bound.
+	maxQuotaPlayers = 10000
+	// quotaSweepInterval is how often Quota forgets the buckets of players
+	// that stopped sending.
+	quotaSweepInterval = time.Minute
+)
+
+// Limit is a token bucket: Rate messages a second on average, with bursts
+// of up to Burst messages. A zero Rate means no limit.
+type Limit struct {
+	Rate  float64 `json:"rate" yaml:"rate"`
+	Burst int     `json:"burst" yaml:"burst"`
+}
+
+func (l Limit) limiter() *rate.Limiter {
+	if l.Rate <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Limit(l.Rate), max(l.Burst, 1))
+}
+
+// LimitPublishes returns b with Publish, PublishBatch and Call waiting for
+// a token from a bucket of limit before sending each message, so a client
+// cannot flood the broker. Everything else goes straight to b.
+func LimitPublishes(b Broker, limit Limit) Broker {
+	return &limitedBroker{Broker: b, limiter: limit.limiter()}
+}
+
+type limitedBroker struct {
+	Broker
+	limiter *rate.Limiter
+}
+
+func (b *limitedBroker) Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	err := b.limiter.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	return b.Broker.Publish(ctx, exchange, key, msg)
+}
+
+// PublishBatch sends the batch in pieces no bigger than the bucket, each
+// once it has the tokens for all of its messages.
+func (b *limitedBroker) PublishBatch(ctx context.Context, msgs []Message) error {
+	step := b.limiter.Burst()
+	if b.limiter.Limit() == rate.Inf || step <= 0 {
+		step = len(msgs)
+	}
+
+	errs := make([]error, len(msgs))
+	for start := 0; start < len(msgs); start += step {
+		end := min(start+step, len(msgs))
+		err := b.limiter.WaitN(ctx, end-start)
+		if err == nil {
+			err = b.Broker.PublishBatch(ctx, msgs[start:end])
+		}
+		if batchErr, ok := err.(*BatchError); ok {
+			copy(errs[start:end], batchErr.Errors)
+			continue
+		}
+		for i := start; i < end; i++ {
+			errs[i] = err
+		}
+	}
+	return batchResult(errs)
+}
+
+func (b *limitedBroker) Call(ctx context.Context, exchange, key string, msg amqp.Publishing) (amqp.Delivery, error) {
+	err := b.limiter.Wait(ctx)
+	if err != nil {
+		return amqp.Delivery{}, err
+	}
+	return b.Broker.Call(ctx, exchange, key, msg)
+}
+
+// Quotas are the per player limits Quota enforces.
+type Quotas struct {
+	// Default applies to players without a limit of their own.
+	Default Limit `json:"default" yaml:"default"`
+	// Players limits individual players, by username.
+	Players map[string]Limit `json:"players" yaml:"players"`
+}
+
+func (q Quotas) limit(username string) Limit {
+	if l, ok := q.Players[username]; ok {
+		return l
+	}
+	return q.Default
+}
+
+// Quota returns middleware that holds every player to their limit in
+// quotas, telling players apart by the username in the routing key.
+// Messages from a player over their limit are answered with over instead
+// of reaching the handler: NackDiscard sends them to the dead letter
+// exchange, RetryLater delays them by the subscription's retry schedule,
+// which should be open ended with WithRetryForever so they are not parked
+// once it is used up.
+//
+// A player's bucket is forgotten once it has filled up again, which loses
+// nothing since a new one starts full. Messages whose routing key names no
+// player, and those of players without a limit of their own once
+// maxQuotaPlayers have a bucket, share one bucket of the default limit.
+func Quota[T any](quotas Quotas, over AckType) (Middleware[T], error) {
+	if over != NackDiscard && over != RetryLater {
+		return nil, fmt.Errorf("pubsub: quota can only answer NackDiscard or RetryLater, not %s", over)
+	}
+
+	q := newQuota(quotas)
+	return func(next Handler[T]) Handler[T] {
+		return func(d Delivery[T]) AckType {
+			username, err := routing.Username(d.RoutingKey)
+			if err != nil {
+				username = ""
+			}
+			if q.allow(username, time.Now()) {
+				return next(d)
+			}
+			quotaExceededTotal.WithLabelValues(over.String()).Inc()
+			// the username logged is the one the quota is kept for, which
+			// comes from the routing key rather than the sender header
+			logger().Warn("player over quota", "exchange", d.Exchange, "routing_key", d.RoutingKey, "message_id", d.MessageID, "username", username, "ack", over.String())
+			return over
+		}
+	}, nil
+}
+
+// quota keeps the token buckets of the players Quota has seen recently.
+type quota struct {
+	quotas Quotas
+
+	mu        sync.Mutex
+	players   map[string]*rate.Limiter
+	shared    *rate.Limiter
+	lastSweep time.Time
+}
+
+func newQuota(quotas Quotas) *quota {
+	return &quota{
+		quotas:    quotas,
+		players:   map[string]*rate.Limiter{},
+		shared:    quotas.Default.limiter(),
+		lastSweep: time.Now(),
+	}
+}
+
+func (q *quota) allow(username string, now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if now.Sub(q.lastSweep) >= quotaSweepInterval {
+		q.sweep(now)
+	}
+
+	limit := q.quotas.limit(username)
+	if limit.Rate <= 0 {
+		return true
+	}
+	l, ok := q.players[username]
+	switch {
+	case ok:
+	case username == "":
+		l = q.shared
+	case len(q.players) >= maxQuotaPlayers && !q.configured(username):
+		l = q.shared
+	default:
+		l = limit.limiter()
+		q.players[username] = l
+	}
+	return l.AllowN(now, 1)
+}
+
+// configured reports whether username has a limit of its own in the
+// quotas, which bounds how many such players there are.
+func (q *quota) configured(username string) bool {
+	_, ok := q.quotas.Players[username]
+	return ok
+}
+
+// sweep forgets the buckets that are full again.
+func (q *quota) sweep(now time.Time) {
+	q.lastSweep = now
+	for username, l := range q.players {
+		if l.TokensAt(now) >= float64(l.Burst()) {
+			delete(q.players, username)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package pubsub
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+func TestQuotaAllow(t *testing.T) {
+	q := newQuota(Quotas{
+		Default: Limit{Rate: 1, Burst: 2},
+		Players: map[string]Limit{"vip": {}, "slow": {Rate: 1, Burst: 1}},
+	})
+	now := time.Now()
+
+	for i, want := range []bool{true, true, false} {
+		if got := q.allow("alice", now); got != want {
+			t.Errorf("alice message %d allowed = %v, want %v", i, got, want)
+		}
+	}
+	if !q.allow("bob", now) {
+		t.Error("bob refused on alice's empty bucket")
+	}
+	for i := 0; i < 10; i++ {
+		if !q.allow("vip", now) {
+			t.Fatal("unlimited player refused")
+		}
+	}
+	if _, ok := q.players["vip"]; ok {
+		t.Error("unlimited player got a bucket")
+	}
+	if !q.allow("slow", now) || q.allow("slow", now) {
+		t.Error("slow player not held to their own limit")
+	}
+	if !q.allow("alice", now.Add(time.Second)) {
+		t.Error("alice's bucket did not refill")
+	}
+}
+
+func TestQuotaSweep(t *testing.T) {
+	q := newQuota(Quotas{Default: Limit{Rate: 1, Burst: 2}})
+	now := time.Now()
+	q.allow("alice", now)
+	q.allow("alice", now)
+	q.allow("bob", now)
+
+	// bob's bucket is full again after a second, alice's after two
+	q.sweep(now.Add(time.Second))
+	if _, ok := q.players["bob"]; ok {
+		t.Error("full bucket kept")
+	}
+	if _, ok := q.players["alice"]; !ok {
+		t.Error("bucket with tokens taken forgotten")
+	}
+
+	q.allow("carol", now.Add(time.Second))
+	if !q.allow("dave", now.Add(quotaSweepInterval+2*time.Second)) {
+		t.Fatal("dave refused")
+	}
+	if len(q.players) != 1 {
+		t.Errorf("%d buckets after the sweep, want only dave's", len(q.players))
+	}
+}
+
+func TestQuotaSharesBucketBeyondCap(t *testing.T) {
+	q := newQuota(Quotas{
+		Default: Limit{Rate: 1, Burst: 1},
+		Players: map[string]Limit{"known": {Rate: 1, Burst: 1}},
+	})
+	now := time.Now()
+	for i := 0; i < maxQuotaPlayers; i++ {
+		q.allow(fmt.Sprintf("player%d", i), now)
+	}
+
+	if !q.allow("stranger", now) {
+		t.Error("first player beyond the cap refused")
+	}
+	if q.allow("another", now) {
+		t.Error("players beyond the cap got a bucket each")
+	}
+	if !q.allow("known", now) {
+		t.Error("player with their own limit refused at the cap")
+	}
+	if len(q.players) != maxQuotaPlayers+1 {
+		t.Errorf("%d buckets, want %d", len(q.players), maxQuotaPlayers+1)
+	}
+}
+
+func TestQuotaMiddleware(t *testing.T) {
+	_, err := Quota[routing.GameLog](Quotas{}, Ack)
+	if err == nil {
+		t.Fatal("Quota accepted Ack for messages over quota")
+	}
+
+	mw, err := Quota[routing.GameLog](Quotas{Default: Limit{Rate: 1, Burst: 1}}, NackDiscard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handled := 0
+	handler := mw(func(Delivery[routing.GameLog]) AckType {
+		handled++
+		return Ack
+	})
+	d := Delivery[routing.GameLog]{RoutingKey: routing.GameLogKey("alice")}
+	if got := handler(d); got != Ack {
+		t.Errorf("first log answered %s", got)
+	}
+	if got := handler(d); got != NackDiscard {
+		t.Errorf("log over quota answered %s, want NackDiscard", got)
+	}
+	if handled != 1 {
+		t.Errorf("handler called %d times, want 1", handled)
+	}
+}
@@ -0,0 +1,104 @@
+package pubsub
+
+import (
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// transientRetryGrace is how much longer than its delay a retry queue
+	// of a transient queue is kept once nothing is retried through it.
+	transientRetryGrace = time.Minute
+	// transientParkingExpiry is how long the parking queue of a transient
+	// queue is kept once nothing is parked in it.
+	transientParkingExpiry = 24 * time.Hour
+)
+
+// RetryQueueName is the queue a message from queueName waits in before its
+// attempt'th retry, counting from 1.
+func RetryQueueName(queueName string, attempt int) string {
+	return fmt.Sprintf("%s.retry.%d", queueName, attempt)
+}
+
+// ParkingQueueName is the queue messages from queueName end up in once they
+// ran out of retries.
+func ParkingQueueName(queueName string) string {
+	return queueName + ".parking"
+}
+
+// retryLater moves a message to the retry queue for its next attempt, or
+// to the parking queue once the retry schedule is used up, and acks it.
+// With WithRetryForever the last retry queue takes the place of parking.
+//
+// Each retry queue holds messages for a fixed TTL and then dead-letters
+// them through the default exchange straight back to the queue they came
+// from. Dead-lettering to the original exchange instead would hand the
+// retry to every other queue bound with the same key as well; the original
+// route is kept in the headers and restored on redelivery.
+//
+// The retry queues of a Transient queue are transient too and expire once
+// unused, so a player who leaves does not leave them behind. They are
+// declared again for every retry, which keeps them from expiring while in
+// use. A retry that comes due after its queue was deleted is dropped.
+func (s *settler) retryLater(message amqp.Delivery) {
+	var err error
+	if s.transient {
+		err = s.declareRetryQueues()
+	} else {
+		s.retryOnce.Do(func() {
+			s.retryErr = s.declareRetryQueues()
+		})
+		err = s.retryErr
+	}
+	if err != nil {
+		logger().Error("unable to declare retry queues, requeueing instead", append(deliveryAttrs(s.queue, message), "error", err)...)
+		message.Nack(false, true)
+		return
+	}
+
+	attempt := int(headerInt(message.Headers[HeaderRetryAttempt])) + 1
+	target := RetryQueueName(s.queue, attempt)
+	switch {
+	case attempt <= len(s.cfg.retrySchedule):
+	case s.cfg.retryForever && len(s.cfg.retrySchedule) > 0:
+		target = RetryQueueName(s.queue, len(s.cfg.retrySchedule))
+	default:
+		logger().Warn("message failed every retry, parking it", append(deliveryAttrs(s.queue, message), "retries", len(s.cfg.retrySchedule))...)
+		target = ParkingQueueName(s.queue)
+	}
+
+	msg := publishingFrom(message)
+	msg.Headers = s.withOrigin(message, amqp.Table{HeaderRetryAttempt: int64(attempt)})
+	err = s.broker.Publish(s.ctx, "", target, msg)
+	if err != nil {
+		logger().Error("unable to move message to retry queue, requeueing instead", append(deliveryAttrs(s.queue, message), "target", target, "error", err)...)
+		message.Nack(false, true)
+		return
+	}
+	message.Ack(false)
+}
+
+func (s *settler) declareRetryQueues() error {
+	for i, delay := range s.cfg.retrySchedule {
+		args := amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": s.queue,
+		}
+		if s.transient {
+			args["x-expires"] = (delay + transientRetryGrace).Milliseconds()
+		}
+		_, err := s.broker.DeclareQueue(s.ctx, RetryQueueName(s.queue, i+1), !s.transient, false, false, args)
+		if err != nil {
+			return err
+		}
+	}
+	var args amqp.Table
+	if s.transient {
+		args = amqp.Table{"x-expires": transientParkingExpiry.Milliseconds()}
+	}
+	_, err := s.broker.DeclareQueue(s.ctx, ParkingQueueName(s.queue), !s.transient, false, false, args)
+	return err
+}
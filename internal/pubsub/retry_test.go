@@ -0,0 +1,194 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// declaringBroker records the queues declared through it.
+type declaringBroker struct {
+	*MemoryBroker
+
+	mu     sync.Mutex
+	queues map[string]queueDecl
+}
+
+func (b *declaringBroker) DeclareQueue(ctx context.Context, name string, durable, autoDelete, exclusive bool, args amqp.Table) (amqp.Queue, error) {
+	b.mu.Lock()
+	b.queues[name] = queueDecl{name: name, durable: durable, autoDelete: autoDelete, exclusive: exclusive, args: args}
+	b.mu.Unlock()
+	return b.MemoryBroker.DeclareQueue(ctx, name, durable, autoDelete, exclusive, args)
+}
+
+func (b *declaringBroker) declared(name string) (queueDecl, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	decl, ok := b.queues[name]
+	return decl, ok
+}
+
+// waitForMessages waits until queueName holds n ready messages.
+func waitForMessages(t *testing.T, b *MemoryBroker, queueName string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		queue, err := b.InspectQueue(context.Background(), queueName)
+		if err == nil && queue.Messages == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s holds %d messages, want %d (%v)", queueName, queue.Messages, n, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRetryParksAfterSchedule(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := perilBroker(t)
+
+	var (
+		mu     sync.Mutex
+		routes []string
+	)
+	schedule := []time.Duration{time.Millisecond, 2 * time.Millisecond}
+	sub, err := SubscribeDelivery(ctx, b, routing.ExchangePerilTopic, "logs", routing.GameLogPattern(), Durable,
+		func(d Delivery[string]) AckType {
+			mu.Lock()
+			routes = append(routes, d.Exchange+" "+d.RoutingKey)
+			mu.Unlock()
+			return RetryLater
+		},
+		WithRetrySchedule(schedule...),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	err = PublishJSON(ctx, b, routing.ExchangePerilTopic, routing.GameLogKey("alice"), "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForMessages(t, b, ParkingQueueName("logs"), 1)
+
+	mu.Lock()
+	if len(routes) != len(schedule)+1 {
+		t.Errorf("handled %d times, want %d", len(routes), len(schedule)+1)
+	}
+	// retries come back through the default exchange, but the handler
+	// sees the route the message was published with every time
+	want := routing.ExchangePerilTopic + " " + routing.GameLogKey("alice")
+	for i, route := range routes {
+		if route != want {
+			t.Errorf("attempt %d delivered as %q, want %q", i, route, want)
+		}
+	}
+	mu.Unlock()
+
+	d := receive(t, consume(t, b, ParkingQueueName("logs")))
+	if got := headerInt(d.Headers[HeaderRetryAttempt]); got != int64(len(schedule)+1) {
+		t.Errorf("parked with %s %d, want %d", HeaderRetryAttempt, got, len(schedule)+1)
+	}
+	if d.Headers[HeaderOriginalExchange] != routing.ExchangePerilTopic || d.Headers[HeaderOriginalRoutingKey] != routing.GameLogKey("alice") || d.Headers[HeaderOriginalQueue] != "logs" {
+		t.Errorf("parked with origin %v %v %v", d.Headers[HeaderOriginalExchange], d.Headers[HeaderOriginalRoutingKey], d.Headers[HeaderOriginalQueue])
+	}
+}
+
+func TestRetryQueuesOfTransientQueueExpire(t *testing.T) {
+	for _, queueType := range []SimpleQueueType{Transient, Durable} {
+		t.Run(string(queueType), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			b := &declaringBroker{MemoryBroker: perilBroker(t), queues: map[string]queueDecl{}}
+
+			retried := make(chan struct{})
+			var attempts atomic.Int64
+			sub, err := Subscribe(ctx, b, routing.ExchangePerilTopic, "moves", "moves.*", queueType, func(string) AckType {
+				if attempts.Add(1) == 1 {
+					return RetryLater
+				}
+				close(retried)
+				return Ack
+			}, WithRetrySchedule(time.Millisecond))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Close()
+
+			err = PublishJSON(ctx, b, routing.ExchangePerilTopic, "moves.alice", "hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-retried:
+			case <-time.After(time.Second):
+				t.Fatal("not retried")
+			}
+
+			transient := queueType == Transient
+			for _, name := range []string{RetryQueueName("moves", 1), ParkingQueueName("moves")} {
+				decl, ok := b.declared(name)
+				if !ok {
+					t.Fatalf("%s not declared", name)
+				}
+				if decl.durable == transient {
+					t.Errorf("%s declared durable %v", name, decl.durable)
+				}
+				_, expires := decl.args["x-expires"]
+				if expires != transient {
+					t.Errorf("%s declared with x-expires %v", name, decl.args["x-expires"])
+				}
+			}
+		})
+	}
+}
+
+func TestRetryForever(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := perilBroker(t)
+
+	var attempts atomic.Int64
+	done := make(chan struct{})
+	sub, err := Subscribe(ctx, b, routing.ExchangePerilTopic, "logs", routing.GameLogPattern(), Durable,
+		func(string) AckType {
+			if attempts.Add(1) < 5 {
+				return RetryLater
+			}
+			close(done)
+			return Ack
+		},
+		WithRetrySchedule(time.Millisecond, 2*time.Millisecond),
+		WithRetryForever(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	err = PublishJSON(ctx, b, routing.ExchangePerilTopic, routing.GameLogKey("alice"), "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("handled %d times, want 5", attempts.Load())
+	}
+
+	parking, err := b.InspectQueue(ctx, ParkingQueueName("logs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parking.Messages != 0 {
+		t.Errorf("%d messages parked", parking.Messages)
+	}
+}
@@ -0,0 +1,326 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DirectReplyTo is RabbitMQ's pseudo-queue for replies: a requester consumes
+// from it and publishes with it as ReplyTo on the same channel, and the
+// server's reply, published to the default exchange with the rewritten
+// ReplyTo as key, goes straight back to that channel.
+const DirectReplyTo = "amq.rabbitmq.reply-to"
+
+// HeaderRPCError carries the error a Serve handler returned.
+const HeaderRPCError = "x-peril-rpc-error"
+
+// defaultRequestTimeout bounds Request when ctx has no deadline.
+const defaultRequestTimeout = 5 * time.Second
+
+// RemoteError is returned by Request when the server's handler failed.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "pubsub: remote handler failed: " + e.Message
+}
+
+// Request publishes req to exchange with key and waits for the typed reply
+// of whoever Serves that route. It gives up when ctx is done, or after five
+// seconds if ctx has no deadline.
+func Request[Req, Resp any](ctx context.Context, b Broker, exchange, key string, req Req) (Resp, error) {
+	var resp Resp
+
+	body, err := jsonCodec{}.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultRequestTimeout)
+		defer cancel()
+	}
+	ctx, span := startPublishSpan(ctx, exchange, key)
+	defer func() { endSpan(span, err) }()
+	reply, err := b.Call(ctx, exchange, key, stamp(ctx, amqp.Publishing{
+		ContentType: ContentTypeJSON,
+		Body:        body,
+	}))
+	if err != nil {
+		return resp, err
+	}
+
+	if remote, ok := reply.Headers[HeaderRPCError].(string); ok {
+		err = &RemoteError{Message: remote}
+		return resp, err
+	}
+	codec, err := LookupCodec(reply.ContentType)
+	if err != nil {
+		return resp, err
+	}
+	err = codec.Unmarshal(reply.Body, &resp)
+	return resp, err
+}
+
+// Serve answers Requests published to exchange with key. Each request is
+// decoded, passed to handler and its result sent back to the requester,
+// encoded like the request was. An error from handler reaches the
+// requester as a *RemoteError.
+func Serve[Req, Resp any](
+	ctx context.Context,
+	b Broker,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(Req) (Resp, error),
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	return subscribe(ctx, b, exchange, queueName, key, queueType, func(ctx context.Context, message amqp.Delivery, req Req) AckType {
+		if message.ReplyTo == "" {
+			logger().Warn("request has no reply-to, discarding it", deliveryAttrs(queueName, message)...)
+			return NackDiscard
+		}
+
+		reply := amqp.Publishing{
+			ContentType:   message.ContentType,
+			CorrelationId: message.CorrelationId,
+		}
+		resp, err := handler(req)
+		if err == nil {
+			var codec Codec
+			codec, err = LookupCodec(message.ContentType)
+			if err == nil {
+				reply.Body, err = codec.Marshal(resp)
+			}
+		}
+		if err != nil {
+			reply.Headers = amqp.Table{HeaderRPCError: err.Error()}
+			reply.Body = nil
+		}
+
+		// a reply that cannot be delivered means the requester gave up;
+		// answering the request again would not help
+		replyCtx := context.WithoutCancel(ctx)
+		err = b.Publish(replyCtx, "", message.ReplyTo, stamp(withCause(replyCtx, metadataFrom(message)), reply))
+		if err != nil {
+			logger().Warn("unable to reply to request", append(deliveryAttrs(queueName, message), "reply_to", message.ReplyTo, "error", err)...)
+		}
+		return Ack
+	}, opts...)
+}
+
+// Call publishes msg as a request over direct reply-to and waits for the
+// reply.
+func (c *Connection) Call(ctx context.Context, exchange, key string, msg amqp.Publishing) (amqp.Delivery, error) {
+	conn, err := c.wait(ctx)
+	if err != nil {
+		return amqp.Delivery{}, err
+	}
+
+	c.mu.Lock()
+	client := c.rpc
+	if client == nil || client.isClosed() {
+		client, err = newRPCClient(conn)
+		if err != nil {
+			c.mu.Unlock()
+			return amqp.Delivery{}, err
+		}
+		c.rpc = client
+	}
+	c.mu.Unlock()
+
+	return client.call(ctx, exchange, key, msg)
+}
+
+type rpcResult struct {
+	reply amqp.Delivery
+	err   error
+}
+
+// rpcClient is a channel consuming from DirectReplyTo that publishes
+// requests and routes replies back to their callers by correlation ID.
+type rpcClient struct {
+	// publishMu serialises publishes on ch
+	publishMu sync.Mutex
+	ch        *amqp.Channel
+
+	mu      sync.Mutex
+	pending map[string]chan rpcResult
+	done    chan struct{}
+}
+
+func newRPCClient(conn *amqp.Connection) (*rpcClient, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	replies, err := ch.Consume(DirectReplyTo, "", true, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	client := &rpcClient{
+		ch:      ch,
+		pending: map[string]chan rpcResult{},
+		done:    make(chan struct{}),
+	}
+	go client.dispatch(replies, ch.NotifyReturn(make(chan amqp.Return, 16)))
+	return client, nil
+}
+
+func (r *rpcClient) dispatch(replies <-chan amqp.Delivery, returns <-chan amqp.Return) {
+	defer r.close()
+	for {
+		select {
+		case reply, ok := <-replies:
+			if !ok {
+				return
+			}
+			r.resolve(reply.CorrelationId, rpcResult{reply: reply})
+		case ret, ok := <-returns:
+			if !ok {
+				return
+			}
+			r.resolve(ret.CorrelationId, rpcResult{err: &ReturnError{
+				Exchange:   ret.Exchange,
+				RoutingKey: ret.RoutingKey,
+				ReplyCode:  ret.ReplyCode,
+				ReplyText:  ret.ReplyText,
+			}})
+		}
+	}
+}
+
+func (r *rpcClient) resolve(correlationID string, result rpcResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if waiter, ok := r.pending[correlationID]; ok {
+		waiter <- result
+		delete(r.pending, correlationID)
+	}
+}
+
+// close fails every pending call once the channel is gone.
+func (r *rpcClient) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, waiter := range r.pending {
+		waiter <- rpcResult{err: amqp.ErrClosed}
+		delete(r.pending, id)
+	}
+	close(r.done)
+}
+
+func (r *rpcClient) isClosed() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *rpcClient) call(ctx context.Context, exchange, key string, msg amqp.Publishing) (amqp.Delivery, error) {
+	msg.CorrelationId = newID()
+	msg.ReplyTo = DirectReplyTo
+
+	waiter := make(chan rpcResult, 1)
+	r.mu.Lock()
+	if r.isClosed() {
+		r.mu.Unlock()
+		return amqp.Delivery{}, amqp.ErrClosed
+	}
+	r.pending[msg.CorrelationId] = waiter
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.pending, msg.CorrelationId)
+		r.mu.Unlock()
+	}()
+
+	r.publishMu.Lock()
+	err := r.ch.PublishWithContext(ctx, exchange, key, true, false, msg)
+	r.publishMu.Unlock()
+	observePublish(exchange, key, err)
+	if err != nil {
+		return amqp.Delivery{}, err
+	}
+
+	select {
+	case result := <-waiter:
+		return result.reply, result.err
+	case <-ctx.Done():
+		return amqp.Delivery{}, fmt.Errorf("pubsub: waiting for reply to %s/%s: %w", exchange, key, ctx.Err())
+	}
+}
+
+// Call publishes msg with a reply-to address that the broker resolves back
+// to the caller, emulating direct reply-to.
+func (b *MemoryBroker) Call(ctx context.Context, exchange, key string, msg amqp.Publishing) (amqp.Delivery, error) {
+	msg.CorrelationId = newID()
+	msg.ReplyTo = DirectReplyTo + "." + msg.CorrelationId
+
+	waiter := make(chan amqp.Delivery, 1)
+	b.mu.Lock()
+	if b.replies == nil {
+		b.replies = map[string]chan amqp.Delivery{}
+	}
+	b.replies[msg.ReplyTo] = waiter
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.replies, msg.ReplyTo)
+		b.mu.Unlock()
+	}()
+
+	err := b.Publish(ctx, exchange, key, msg)
+	if err != nil {
+		return amqp.Delivery{}, err
+	}
+
+	select {
+	case reply := <-waiter:
+		return reply, nil
+	case <-ctx.Done():
+		return amqp.Delivery{}, fmt.Errorf("pubsub: waiting for reply to %s/%s: %w", exchange, key, ctx.Err())
+	case <-b.done:
+		return amqp.Delivery{}, ErrConnectionClosed
+	}
+}
+
+// reply hands a message published to a reply-to address to the waiting
+// caller. The caller must hold b.mu.
+func (b *MemoryBroker) reply(key string, msg amqp.Publishing) bool {
+	if !strings.HasPrefix(key, DirectReplyTo+".") {
+		return false
+	}
+	waiter, ok := b.replies[key]
+	if !ok {
+		return false
+	}
+	select {
+	case waiter <- memMessage{key: key, msg: msg}.delivery(nil, "", 0):
+	default:
+	}
+	return true
+}
+
+// newID returns a random identifier for correlating messages.
+func newID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id[:])
+}
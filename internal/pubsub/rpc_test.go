@@ -0,0 +1,87 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+type sumRequest struct {
+	A, B int
+}
+
+type sumResponse struct {
+	Sum int
+}
+
+// serveSums answers sum requests on routing key "sum", refusing negative
+// numbers.
+func serveSums(t *testing.T, ctx context.Context, b Broker) {
+	t.Helper()
+	sub, err := Serve(ctx, b, routing.ExchangePerilDirect, "sums", "sum", Transient, func(req sumRequest) (sumResponse, error) {
+		if req.A < 0 || req.B < 0 {
+			return sumResponse{}, errors.New("negative numbers are not supported")
+		}
+		return sumResponse{Sum: req.A + req.B}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close() })
+}
+
+func TestRequestServeRoundTrip(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := perilBroker(t)
+	serveSums(t, ctx, b)
+
+	resp, err := Request[sumRequest, sumResponse](ctx, b, routing.ExchangePerilDirect, "sum", sumRequest{A: 2, B: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Sum != 5 {
+		t.Errorf("got sum %d, want 5", resp.Sum)
+	}
+}
+
+func TestRequestRemoteError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := perilBroker(t)
+	serveSums(t, ctx, b)
+
+	_, err := Request[sumRequest, sumResponse](ctx, b, routing.ExchangePerilDirect, "sum", sumRequest{A: -1, B: 3})
+	var remote *RemoteError
+	if !errors.As(err, &remote) {
+		t.Fatalf("got %v, want a *RemoteError", err)
+	}
+	if remote.Message != "negative numbers are not supported" {
+		t.Errorf("got remote error %q", remote.Message)
+	}
+}
+
+func TestRequestWithoutServer(t *testing.T) {
+	b := perilBroker(t)
+	declareBound(t, b, routing.ExchangePerilDirect, "sums", "sum", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := Request[sumRequest, sumResponse](ctx, b, routing.ExchangePerilDirect, "sum", sumRequest{A: 2, B: 3})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %s", elapsed)
+	}
+
+	_, err = Request[sumRequest, sumResponse](context.Background(), b, routing.ExchangePerilDirect, "nobody", sumRequest{})
+	var returned *ReturnError
+	if !errors.As(err, &returned) {
+		t.Errorf("unroutable request got %v, want a *ReturnError", err)
+	}
+}
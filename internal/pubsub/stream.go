@@ -0,0 +1,279 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// HeaderStreamOffset is the header RabbitMQ puts a message's offset in when
+// it is delivered from a stream.
+const HeaderStreamOffset = "x-stream-offset"
+
+// defaultStreamPrefetch is the prefetch a stream subscription uses unless
+// WithPrefetch says otherwise; RabbitMQ refuses stream consumers without
+// one.
+const defaultStreamPrefetch = 100
+
+// StreamOffset is where SubscribeStream starts reading a stream.
+type StreamOffset struct {
+	// spec is "first", "last", "next", an int64 offset or a time.Time
+	spec any
+	// store and name are set for OffsetStored
+	store OffsetStore
+	name  string
+}
+
+var (
+	// OffsetFirst reads the stream from the oldest message it still keeps.
+	OffsetFirst = StreamOffset{spec: "first"}
+	// OffsetLast reads from the last chunk RabbitMQ wrote, which holds the
+	// most recent messages.
+	OffsetLast = StreamOffset{spec: "last"}
+	// OffsetNext reads only messages published from now on.
+	OffsetNext = StreamOffset{spec: "next"}
+)
+
+// OffsetAt reads from the message at offset.
+func OffsetAt(offset int64) StreamOffset {
+	return StreamOffset{spec: offset}
+}
+
+// OffsetTimestamp reads from the first chunk written at or after t. Chunks
+// hold several messages, so a few from just before t may be delivered too.
+func OffsetTimestamp(t time.Time) StreamOffset {
+	return StreamOffset{spec: t}
+}
+
+// OffsetStored resumes after the last offset store has for name and starts
+// at from if it has none. The subscription stores the offset of every
+// message it handles under name, so a restarted reader carries on where it
+// stopped. Readers that must not share progress need different names.
+func OffsetStored(store OffsetStore, name string, from StreamOffset) StreamOffset {
+	return StreamOffset{spec: from.spec, store: store, name: name}
+}
+
+// String returns the offset the way x-stream-offset would take it.
+func (o StreamOffset) String() string {
+	if o.store != nil {
+		return fmt.Sprintf("stored %q, else %v", o.name, o.spec)
+	}
+	return fmt.Sprint(o.spec)
+}
+
+// start returns the x-stream-offset to start from.
+func (o StreamOffset) start() (any, error) {
+	if o.store != nil {
+		offset, ok, err := o.store.LoadOffset(o.name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return offset + 1, nil
+		}
+	}
+	if o.spec == nil {
+		return "next", nil
+	}
+	return o.spec, nil
+}
+
+// SubscribeStream reads the stream queueName from offset and calls handler
+// for every message, one at a time and in order. The stream must already
+// exist, e.g. declared by the server's topology.
+//
+// A stream keeps its messages for every reader, so unlike Subscribe there
+// is nothing to requeue or dead-letter: whatever handler returns, the
+// message is acked and the next one delivered. Messages that do not decode
+// are skipped and reported to the error handler. After a reconnect reading
+// resumes after the last message handled.
+func SubscribeStream[T any](
+	ctx context.Context,
+	b Broker,
+	queueName string,
+	offset StreamOffset,
+	handler Handler[T],
+	opts ...SubscribeOption,
+) (*Subscription, error) {
+	cfg := newSubscribeConfig(opts)
+	cfg.stream = true
+	cfg.workers = 1
+	cfg.orderingKey = nil
+	if cfg.consume.PrefetchCount == 0 {
+		cfg.consume.PrefetchCount = defaultStreamPrefetch
+	}
+
+	var wrapped deliveryHandler[T] = func(ctx context.Context, message amqp.Delivery, payload T) AckType {
+		return handler(newDelivery(ctx, message, payload))
+	}
+	if cfg.dedup != nil {
+		wrapped = deduplicate(cfg.dedup, queueName, wrapped)
+	}
+	wrapped, err := chain(cfg, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	first, err := offset.start()
+	if err != nil {
+		return nil, fmt.Errorf("stream %s: loading offset: %w", queueName, err)
+	}
+	// last is the offset of the last message handled, -1 before the first
+	var last atomic.Int64
+	last.Store(-1)
+	cfg.consume.Arguments = func() amqp.Table {
+		if n := last.Load(); n >= 0 {
+			return amqp.Table{HeaderStreamOffset: n + 1}
+		}
+		return amqp.Table{HeaderStreamOffset: first}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	delivery, err := b.Consume(ctx, queueName, cfg.consume)
+	if err != nil {
+		cancel()
+		logger().Error("unable to consume stream", "queue", queueName, "offset", offset.String(), "error", err)
+		return nil, err
+	}
+
+	settle := newSettler(ctx, b, queueName, Durable, cfg)
+	sub := newSubscription(cancel)
+	go func() {
+		runWorkers(delivery, cfg, func(message amqp.Delivery) {
+			acknowledgeDelivery(ctx, settle, message, wrapped)
+			n, ok := messageOffset(message)
+			if !ok {
+				return
+			}
+			last.Store(n)
+			if offset.store == nil {
+				return
+			}
+			err := offset.store.StoreOffset(offset.name, n)
+			if err != nil {
+				cfg.onError(fmt.Errorf("stream %s: storing offset %d: %w", queueName, n, err))
+			}
+		})
+		sub.finish(nil)
+	}()
+	return sub, nil
+}
+
+// StreamOffset returns the offset of a message read from a stream.
+func (d Delivery[T]) StreamOffset() (int64, bool) {
+	return messageOffset(d.message)
+}
+
+func messageOffset(message amqp.Delivery) (int64, bool) {
+	v, ok := message.Headers[HeaderStreamOffset]
+	if !ok {
+		return 0, false
+	}
+	return headerInt(v), true
+}
+
+// OffsetStore remembers how far named stream readers got, for
+// OffsetStored.
+type OffsetStore interface {
+	// LoadOffset returns the last offset stored for name, if any.
+	LoadOffset(name string) (offset int64, ok bool, err error)
+	// StoreOffset records offset as handled by name.
+	StoreOffset(name string, offset int64) error
+}
+
+var (
+	_ OffsetStore = (*MemoryOffsetStore)(nil)
+	_ OffsetStore = (*FileOffsetStore)(nil)
+)
+
+// MemoryOffsetStore is an OffsetStore that forgets everything when the
+// process exits.
+type MemoryOffsetStore struct {
+	mu      sync.Mutex
+	offsets map[string]int64
+}
+
+func NewMemoryOffsetStore() *MemoryOffsetStore {
+	return &MemoryOffsetStore{offsets: map[string]int64{}}
+}
+
+func (s *MemoryOffsetStore) LoadOffset(name string) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offset, ok := s.offsets[name]
+	return offset, ok, nil
+}
+
+func (s *MemoryOffsetStore) StoreOffset(name string, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offsets[name] = offset
+	return nil
+}
+
+// FileOffsetStore is an OffsetStore kept in a JSON file, so readers carry on
+// after a restart. Every store rewrites the file, which is fine for the
+// rate a replay tool reads at.
+type FileOffsetStore struct {
+	path string
+
+	mu      sync.Mutex
+	offsets map[string]int64
+}
+
+// OpenFileOffsetStore loads the offsets in path, which need not exist yet.
+func OpenFileOffsetStore(path string) (*FileOffsetStore, error) {
+	s := &FileOffsetStore{path: path, offsets: map[string]int64{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &s.offsets)
+	if err != nil {
+		return nil, fmt.Errorf("offset store %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *FileOffsetStore) LoadOffset(name string) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offset, ok := s.offsets[name]
+	return offset, ok, nil
+}
+
+// StoreOffset writes the offsets to a temporary file and renames it over
+// the old one, so a crash leaves either the old or the new offsets.
+func (s *FileOffsetStore) StoreOffset(name string, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offsets[name] = offset
+
+	data, err := json.Marshal(s.offsets)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
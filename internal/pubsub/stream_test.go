@@ -0,0 +1,253 @@
+package pubsub
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// streamBroker returns a memory broker with a stream holding the messages
+// 0, 1 and 2 at those offsets, and a time between the second and third.
+func streamBroker(t *testing.T) (*MemoryBroker, time.Time) {
+	t.Helper()
+	b := NewMemoryBroker()
+	t.Cleanup(func() { b.Close() })
+	declare(t, b, "log", amqp.Table{"x-queue-type": string(routing.QueueStream)})
+	var between time.Time
+	for i := range 3 {
+		if i == 2 {
+			time.Sleep(time.Millisecond)
+			between = time.Now()
+			time.Sleep(time.Millisecond)
+		}
+		err := PublishJSON(context.Background(), b, "", "log", i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return b, between
+}
+
+// readStream subscribes to the stream from offset and sends the offset of
+// every message handled.
+func readStream(t *testing.T, b Broker, offset StreamOffset) <-chan int64 {
+	t.Helper()
+	offsets := make(chan int64, 10)
+	sub, err := SubscribeStream(context.Background(), b, "log", offset, func(d Delivery[int]) AckType {
+		n, ok := d.StreamOffset()
+		if !ok || n != int64(d.Payload) {
+			t.Errorf("message %d delivered at offset %d, %v", d.Payload, n, ok)
+		}
+		offsets <- n
+		return Ack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sub.Close() })
+	return offsets
+}
+
+func receiveOffset(t *testing.T, offsets <-chan int64, want int64) {
+	t.Helper()
+	select {
+	case got := <-offsets:
+		if got != want {
+			t.Errorf("read offset %d, want %d", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("offset %d never read", want)
+	}
+}
+
+// waitForOffset waits for the subscription to store want under name, which
+// it does after handling the message.
+func waitForOffset(t *testing.T, store OffsetStore, name string, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		n, _, _ := store.LoadOffset(name)
+		if n == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stored offset %d, want %d", n, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStreamOffsetSpecs(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset func(between time.Time) StreamOffset
+		want   int64
+	}{
+		{"first", func(time.Time) StreamOffset { return OffsetFirst }, 0},
+		{"last", func(time.Time) StreamOffset { return OffsetLast }, 2},
+		{"next", func(time.Time) StreamOffset { return OffsetNext }, 3},
+		{"at", func(time.Time) StreamOffset { return OffsetAt(1) }, 1},
+		{"timestamp", OffsetTimestamp, 2},
+		{"stored without an offset", func(time.Time) StreamOffset { return OffsetStored(NewMemoryOffsetStore(), "reader", OffsetAt(1)) }, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, between := streamBroker(t)
+			offsets := readStream(t, b, tt.offset(between))
+			err := PublishJSON(context.Background(), b, "", "log", 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for n := tt.want; n <= 3; n++ {
+				receiveOffset(t, offsets, n)
+			}
+		})
+	}
+}
+
+func TestStreamResumesAfterStoredOffset(t *testing.T) {
+	b, _ := streamBroker(t)
+	store := NewMemoryOffsetStore()
+	store.StoreOffset("reader", 0)
+
+	offsets := readStream(t, b, OffsetStored(store, "reader", OffsetFirst))
+	receiveOffset(t, offsets, 1)
+	receiveOffset(t, offsets, 2)
+	waitForOffset(t, store, "reader", 2)
+}
+
+// reconnectingBroker consumes again with fresh arguments whenever
+// reconnect is called, as a Connection does after the broker drops it.
+type reconnectingBroker struct {
+	*MemoryBroker
+	reconnects chan struct{}
+
+	mu   sync.Mutex
+	args []amqp.Table
+}
+
+func (b *reconnectingBroker) Consume(ctx context.Context, queueName string, opts ConsumeOptions) (<-chan amqp.Delivery, error) {
+	out := make(chan amqp.Delivery)
+	consume := func() (<-chan amqp.Delivery, context.CancelFunc, error) {
+		b.mu.Lock()
+		b.args = append(b.args, opts.Arguments())
+		b.mu.Unlock()
+		ctx, cancel := context.WithCancel(ctx)
+		in, err := b.MemoryBroker.Consume(ctx, queueName, opts)
+		return in, cancel, err
+	}
+	in, cancel, err := consume()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case d, ok := <-in:
+				if !ok {
+					cancel()
+					return
+				}
+				out <- d
+			case <-b.reconnects:
+				cancel()
+				in, cancel, err = consume()
+				if err != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (b *reconnectingBroker) reconnect() {
+	b.reconnects <- struct{}{}
+}
+
+func TestStreamResumesAfterReconnect(t *testing.T) {
+	mb, _ := streamBroker(t)
+	b := &reconnectingBroker{MemoryBroker: mb, reconnects: make(chan struct{})}
+	store := NewMemoryOffsetStore()
+
+	offsets := readStream(t, b, OffsetStored(store, "reader", OffsetFirst))
+	for n := range int64(3) {
+		receiveOffset(t, offsets, n)
+	}
+	waitForOffset(t, store, "reader", 2)
+
+	b.reconnect()
+	err := PublishJSON(context.Background(), b, "", "log", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiveOffset(t, offsets, 3)
+	select {
+	case n := <-offsets:
+		t.Errorf("offset %d read again after reconnecting", n)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.args) != 2 || b.args[0][HeaderStreamOffset] != "first" || b.args[1][HeaderStreamOffset] != int64(3) {
+		t.Errorf("consumed with %v, want first then 3", b.args)
+	}
+}
+
+func TestFileOffsetStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "offsets.json")
+	s, err := OpenFileOffsetStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := s.LoadOffset("reader"); ok {
+		t.Error("offset loaded from a new file")
+	}
+	for _, n := range []int64{4, 7} {
+		err = s.StoreOffset("reader", n)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.StoreOffset("other", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenFileOffsetStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]int64{"reader": 7, "other": 1} {
+		n, ok, err := reopened.LoadOffset(name)
+		if err != nil || !ok || n != want {
+			t.Errorf("reopened %s at %d, %v, %v, want %d", name, n, ok, err, want)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+
+	err = os.WriteFile(path, []byte("{"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenFileOffsetStore(path)
+	if err == nil {
+		t.Error("opened a corrupt offset file")
+	}
+}
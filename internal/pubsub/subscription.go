@@ -0,0 +1,129 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Subscription is a handle on a running consumer started by SubscribeJSON or
+// SubscribeGob.
+type Subscription struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+func newSubscription(cancel context.CancelFunc) *Subscription {
+	return &Subscription{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+}
+
+// Close stops the consumer and waits for the handler that is currently
+// running to finish and acknowledge its message. Messages the broker had
+// already prefetched but that were not handled yet are requeued.
+func (s *Subscription) Close() error {
+	s.cancel()
+	return s.Wait()
+}
+
+// Wait blocks until the subscription stops, either because it was closed,
+// its context was cancelled or the connection was closed, and returns the
+// error that stopped it, if any.
+func (s *Subscription) Wait() error {
+	<-s.done
+	return s.err
+}
+
+func (s *Subscription) finish(err error) {
+	s.err = err
+	s.cancel()
+	close(s.done)
+}
+
+// consumer is a single consumer on a single AMQP channel.
+type consumer struct {
+	ch         consumerChannel
+	tag        string
+	deliveries <-chan amqp.Delivery
+	// pending counts deliveries handed out but not yet acked or nacked
+	pending sync.WaitGroup
+}
+
+// consumerChannel is the part of *amqp.Channel a consumer uses.
+type consumerChannel interface {
+	Cancel(consumer string, noWait bool) error
+	Close() error
+}
+
+// forward passes deliveries on to out until either the consumer goes away,
+// in which case it returns true so the caller can start a new one, or ctx is
+// done, in which case the consumer is stopped and it returns false.
+func (cons *consumer) forward(ctx context.Context, out chan<- amqp.Delivery) bool {
+	for {
+		select {
+		case d, ok := <-cons.deliveries:
+			if !ok {
+				return true
+			}
+			cons.pending.Add(1)
+			d.Acknowledger = &trackingAcknowledger{Acknowledger: d.Acknowledger, pending: &cons.pending}
+			select {
+			case out <- d:
+			case <-ctx.Done():
+				d.Nack(false, true)
+				cons.stop()
+				return false
+			}
+		case <-ctx.Done():
+			cons.stop()
+			return false
+		}
+	}
+}
+
+// stop cancels the consumer tag so the broker stops delivering, requeues
+// everything that was prefetched but never handed out and closes the
+// channel once the deliveries that were handed out have been settled.
+func (cons *consumer) stop() {
+	if err := cons.ch.Cancel(cons.tag, false); err == nil {
+		for d := range cons.deliveries {
+			d.Nack(false, true)
+		}
+	}
+	go func() {
+		cons.pending.Wait()
+		cons.ch.Close()
+	}()
+}
+
+// trackingAcknowledger marks a delivery as settled on its first
+// acknowledgement. Deliveries are always settled one at a time, never with
+// multiple set.
+type trackingAcknowledger struct {
+	amqp.Acknowledger
+	once    sync.Once
+	pending *sync.WaitGroup
+}
+
+func (a *trackingAcknowledger) Ack(tag uint64, multiple bool) error {
+	defer a.settle()
+	return a.Acknowledger.Ack(tag, multiple)
+}
+
+func (a *trackingAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	defer a.settle()
+	return a.Acknowledger.Nack(tag, multiple, requeue)
+}
+
+func (a *trackingAcknowledger) Reject(tag uint64, requeue bool) error {
+	defer a.settle()
+	return a.Acknowledger.Reject(tag, requeue)
+}
+
+func (a *trackingAcknowledger) settle() {
+	a.once.Do(a.pending.Done)
+}
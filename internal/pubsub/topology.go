@@ -0,0 +1,132 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Inspector is implemented by brokers that can check whether an exchange or
+// queue exists without creating it, using passive declares.
+type Inspector interface {
+	// InspectExchange returns an *amqp.Error with code 404 if the
+	// exchange does not exist.
+	InspectExchange(ctx context.Context, name, kind string) error
+	// InspectQueue returns an *amqp.Error with code 404 if the queue does
+	// not exist.
+	InspectQueue(ctx context.Context, name string) (amqp.Queue, error)
+}
+
+var (
+	_ Inspector = (*Connection)(nil)
+	_ Inspector = (*MemoryBroker)(nil)
+)
+
+const driftMissing = "missing"
+
+// Drift is a difference between a topology and what is on the broker.
+type Drift struct {
+	// Kind is "exchange" or "queue".
+	Kind    string
+	Name    string
+	Problem string
+}
+
+// Missing reports whether the entity does not exist at all, as opposed to
+// existing with other settings.
+func (d Drift) Missing() bool {
+	return d.Problem == driftMissing
+}
+
+func (d Drift) String() string {
+	return fmt.Sprintf("%s %s: %s", d.Kind, d.Name, d.Problem)
+}
+
+// DeclareTopology declares everything in t. Declaring is idempotent, so it
+// is safe on every start. An entity that exists with other settings is not
+// changed; its error, like every other, is joined into the one returned, so
+// the rest of the topology is still declared.
+func DeclareTopology(ctx context.Context, b Broker, t routing.Topology) error {
+	var errs []error
+	for _, e := range t.Exchanges {
+		err := b.DeclareExchange(ctx, e.Name, e.Kind)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("exchange %s: %w", e.Name, err))
+		}
+	}
+	for _, q := range t.Queues {
+		_, err := b.DeclareQueue(ctx, q.Name, q.Durable, q.AutoDelete, q.Exclusive, queueArgs(q.Table()))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("queue %s: %w", q.Name, err))
+		}
+	}
+	for _, binding := range t.Bindings {
+		err := b.BindQueue(ctx, binding.Queue, binding.Key, binding.Exchange)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("binding %s -> %s (%q): %w", binding.Exchange, binding.Queue, binding.Key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// VerifyTopology checks with passive declares that every exchange and queue
+// in t exists, and reports those that do not. Passive declares cannot see
+// bindings or queue arguments; DeclareTopology reports arguments that differ.
+func VerifyTopology(ctx context.Context, i Inspector, t routing.Topology) ([]Drift, error) {
+	var drift []Drift
+	for _, e := range t.Exchanges {
+		err := i.InspectExchange(ctx, e.Name, e.Kind)
+		if d, ok := driftFrom("exchange", e.Name, err); ok {
+			drift = append(drift, d)
+		} else if err != nil {
+			return drift, err
+		}
+	}
+	for _, q := range t.Queues {
+		_, err := i.InspectQueue(ctx, q.Name)
+		if d, ok := driftFrom("queue", q.Name, err); ok {
+			drift = append(drift, d)
+		} else if err != nil {
+			return drift, err
+		}
+	}
+	return drift, nil
+}
+
+func driftFrom(kind, name string, err error) (Drift, bool) {
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) {
+		return Drift{}, false
+	}
+	switch amqpErr.Code {
+	case amqp.NotFound:
+		return Drift{Kind: kind, Name: name, Problem: driftMissing}, true
+	case amqp.PreconditionFailed:
+		return Drift{Kind: kind, Name: name, Problem: amqpErr.Reason}, true
+	default:
+		return Drift{}, false
+	}
+}
+
+// queueArgs converts queue arguments to an amqp.Table. JSON has only
+// floats, but the broker wants integers for arguments like x-message-ttl.
+func queueArgs(args map[string]any) amqp.Table {
+	if len(args) == 0 {
+		return nil
+	}
+	table := amqp.Table{}
+	for k, v := range args {
+		if f, ok := v.(float64); ok && f == math.Trunc(f) {
+			v = int64(f)
+		}
+		if n, ok := v.(int); ok {
+			v = int64(n)
+		}
+		table[k] = v
+	}
+	return table
+}
@@ -0,0 +1,111 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// driftingInspector refuses a passive declare of the queues in differ as
+// RabbitMQ does for a queue declared with other flags.
+type driftingInspector struct {
+	*MemoryBroker
+	differ map[string]bool
+}
+
+func (i driftingInspector) InspectQueue(ctx context.Context, name string) (amqp.Queue, error) {
+	if i.differ[name] {
+		return amqp.Queue{}, &amqp.Error{Code: amqp.PreconditionFailed, Reason: "PRECONDITION_FAILED - inequivalent arg 'durable'"}
+	}
+	return i.MemoryBroker.InspectQueue(ctx, name)
+}
+
+func TestVerifyTopology(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	drift, err := VerifyTopology(ctx, b, routing.PerilTopology)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift) != len(routing.PerilTopology.Exchanges)+len(routing.PerilTopology.Queues) {
+		t.Errorf("fresh broker drifted by %v", drift)
+	}
+	for _, d := range drift {
+		if !d.Missing() {
+			t.Errorf("%s on a fresh broker, want it missing", d)
+		}
+	}
+
+	err = DeclareTopology(ctx, b, routing.PerilTopology)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drift, err = VerifyTopology(ctx, driftingInspector{MemoryBroker: b, differ: map[string]bool{routing.QueueWar: true}}, routing.PerilTopology)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Drift{{Kind: "queue", Name: routing.QueueWar, Problem: "PRECONDITION_FAILED - inequivalent arg 'durable'"}}
+	if !reflect.DeepEqual(drift, want) {
+		t.Errorf("got drift %v, want %v", drift, want)
+	}
+	if drift[0].Missing() {
+		t.Error("differing queue reported missing")
+	}
+
+	b.Close()
+	_, err = VerifyTopology(ctx, b, routing.PerilTopology)
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Errorf("closed broker got %v, want ErrConnectionClosed", err)
+	}
+}
+
+func TestDeclareTopologyDeclaresTheRest(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBroker()
+	defer b.Close()
+	// game_logs is in the way with other flags
+	_, err := b.DeclareQueue(ctx, routing.QueueGameLogs, false, true, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = DeclareTopology(ctx, b, routing.PerilTopology)
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) || amqpErr.Code != amqp.PreconditionFailed {
+		t.Fatalf("got %v, want PRECONDITION_FAILED", err)
+	}
+	drift, err := VerifyTopology(ctx, b, routing.PerilTopology)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift) != 0 {
+		t.Errorf("rest of the topology not declared: %v", drift)
+	}
+}
+
+func TestQueueArgs(t *testing.T) {
+	got := queueArgs(map[string]any{
+		"x-message-ttl": float64(60000),
+		"x-max-length":  10,
+		"x-ratio":       0.5,
+		"x-queue-type":  "quorum",
+	})
+	want := amqp.Table{
+		"x-message-ttl": int64(60000),
+		"x-max-length":  int64(10),
+		"x-ratio":       0.5,
+		"x-queue-type":  "quorum",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if queueArgs(nil) != nil {
+		t.Error("no arguments became an empty table")
+	}
+}
@@ -0,0 +1,138 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+
+// propagator carries traces in W3C traceparent and tracestate headers.
+var propagator = propagation.TraceContext{}
+
+// tracer uses whichever provider is registered globally, so spans cost
+// nothing until SetupTracing or the program registers one.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// headerCarrier lets the propagator read and write AMQP headers.
+type headerCarrier amqp.Table
+
+func (c headerCarrier) Get(key string) string {
+	v, _ := c[key].(string)
+	return v
+}
+
+func (c headerCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// injectTrace writes the span in ctx to headers.
+func injectTrace(ctx context.Context, headers amqp.Table) {
+	propagator.Inject(ctx, headerCarrier(headers))
+}
+
+// extractTrace returns ctx with the remote span recorded in headers.
+func extractTrace(ctx context.Context, headers amqp.Table) context.Context {
+	if headers == nil {
+		return ctx
+	}
+	return propagator.Extract(ctx, headerCarrier(headers))
+}
+
+// startPublishSpan starts the producer span for a message published to
+// exchange with key. The span has to be started before the message is
+// stamped so its traceparent points at it.
+func startPublishSpan(ctx context.Context, exchange, key string) (context.Context, trace.Span) {
+	destination := exchange
+	if destination == "" {
+		destination = "(default)"
+	}
+	return tracer().Start(ctx, destination+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "rabbitmq"),
+			attribute.String("messaging.operation", "publish"),
+			attribute.String("messaging.destination.name", exchange),
+			attribute.String("messaging.rabbitmq.destination.routing_key", key),
+		),
+	)
+}
+
+// startProcessSpan starts the consumer span for handling message from
+// queue, as a child of the span that published it.
+func startProcessSpan(ctx context.Context, queue string, message amqp.Delivery) (context.Context, trace.Span) {
+	ctx = extractTrace(ctx, message.Headers)
+	return tracer().Start(ctx, queue+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "rabbitmq"),
+			attribute.String("messaging.operation", "process"),
+			attribute.String("messaging.destination.name", message.Exchange),
+			attribute.String("messaging.rabbitmq.destination.routing_key", message.RoutingKey),
+			attribute.String("messaging.source.name", queue),
+			attribute.String("messaging.message.id", message.MessageId),
+		),
+	)
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// SetupTracing exports spans to dest and registers the provider globally:
+// as readable JSON to "stdout", or as OTLP JSON lines to any other dest,
+// a file path, for an OpenTelemetry collector's otlpjsonfile receiver. The
+// returned function flushes and stops the exporter. An empty dest leaves
+// tracing off.
+func SetupTracing(serviceName, dest string) (shutdown func(context.Context) error, err error) {
+	if dest == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	if dest == "stdout" {
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		file, err := os.OpenFile(dest, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("pubsub: opening trace file: %w", err)
+		}
+		exporter = newOTLPFileExporter(file)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,46 @@
+package pubsub
+
+import (
+	"hash/fnv"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// runWorkers calls handle for every delivery on cfg.workers goroutines and
+// returns once deliveries is closed and every worker is done.
+func runWorkers(deliveries <-chan amqp.Delivery, cfg subscribeConfig, handle func(amqp.Delivery)) {
+	var wg sync.WaitGroup
+	work := func(messages <-chan amqp.Delivery) {
+		defer wg.Done()
+		for message := range messages {
+			handle(message)
+		}
+	}
+
+	if cfg.orderingKey == nil {
+		wg.Add(cfg.workers)
+		for i := 0; i < cfg.workers; i++ {
+			go work(deliveries)
+		}
+		wg.Wait()
+		return
+	}
+
+	// route every key to the same worker so its messages stay in order
+	lanes := make([]chan amqp.Delivery, cfg.workers)
+	wg.Add(cfg.workers)
+	for i := range lanes {
+		lanes[i] = make(chan amqp.Delivery)
+		go work(lanes[i])
+	}
+	for message := range deliveries {
+		h := fnv.New32a()
+		h.Write([]byte(cfg.orderingKey(restoreRoute(message))))
+		lanes[h.Sum32()%uint32(len(lanes))] <- message
+	}
+	for _, lane := range lanes {
+		close(lane)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,134 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+type sequenced struct {
+	Key string
+	Seq int
+}
+
+func TestOrderingKeyKeepsKeysInOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := perilBroker(t)
+
+	const keys, perKey = 4, 50
+	var (
+		mu       sync.Mutex
+		seen     = map[string][]int{}
+		handled  int
+		inFlight int
+		maxIn    int
+	)
+	done := make(chan struct{})
+	sub, err := Subscribe(ctx, b, routing.ExchangePerilTopic, "ordered", "ordered.*", Durable, func(m sequenced) AckType {
+		mu.Lock()
+		inFlight++
+		maxIn = max(maxIn, inFlight)
+		mu.Unlock()
+
+		// give other keys a chance to overtake
+		time.Sleep(time.Duration(m.Seq%3) * time.Millisecond)
+
+		mu.Lock()
+		defer mu.Unlock()
+		inFlight--
+		seen[m.Key] = append(seen[m.Key], m.Seq)
+		if handled++; handled == keys*perKey {
+			close(done)
+		}
+		return Ack
+	},
+		WithWorkers(keys),
+		WithOrderingKey(ByRoutingKey),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	for seq := 0; seq < perKey; seq++ {
+		for k := 0; k < keys; k++ {
+			key := fmt.Sprintf("ordered.%d", k)
+			err := PublishJSON(ctx, b, routing.ExchangePerilTopic, key, sequenced{Key: key, Seq: seq})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not every message handled")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for key, seqs := range seen {
+		for i, seq := range seqs {
+			if seq != i {
+				t.Errorf("%s handled out of order: %v", key, seqs)
+				break
+			}
+		}
+	}
+	if maxIn < 2 {
+		t.Error("keys never handled at the same time")
+	}
+}
+
+func TestWorkersHandleConcurrently(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := perilBroker(t)
+
+	const workers = 3
+	var arrived sync.WaitGroup
+	arrived.Add(workers)
+	release := make(chan struct{})
+	sub, err := Subscribe(ctx, b, routing.ExchangePerilTopic, "parallel", "parallel.*", Durable, func(int) AckType {
+		arrived.Done()
+		<-release
+		return Ack
+	}, WithWorkers(workers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	defer close(release)
+
+	for i := 0; i < workers; i++ {
+		err := PublishJSON(ctx, b, routing.ExchangePerilTopic, "parallel.x", i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all := make(chan struct{})
+	go func() {
+		arrived.Wait()
+		close(all)
+	}()
+	select {
+	case <-all:
+	case <-time.After(time.Second):
+		t.Fatalf("%d workers did not all get a message at once", workers)
+	}
+}
+
+func TestConnectionRefusesPrefetchSize(t *testing.T) {
+	c := disconnected()
+	_, err := c.Consume(context.Background(), "moves", ConsumeOptions{PrefetchCount: 10, PrefetchSize: 4096})
+	if !errors.Is(err, ErrPrefetchSize) {
+		t.Errorf("got %v, want ErrPrefetchSize", err)
+	}
+}
@@ -0,0 +1,116 @@
+package routing
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Routing keys are dot separated words. Per-player keys are a family prefix
+// followed by the username, e.g. army_moves.alice. Usernames must not
+// contain dots, or ParseKey would split them.
+
+// ArmyMovesKey is the key a player's moves are published with.
+func ArmyMovesKey(username string) string {
+	return ArmyMovesPrefix + "." + username
+}
+
+// ArmyMovesPattern binds to every player's moves.
+func ArmyMovesPattern() string {
+	return ArmyMovesPrefix + ".*"
+}
+
+// WarKey is the key a war recognised by username is published with.
+func WarKey(username string) string {
+	return WarRecognitionsPrefix + "." + username
+}
+
+// WarPattern binds to every player's war recognitions.
+func WarPattern() string {
+	return WarRecognitionsPrefix + ".*"
+}
+
+// GameLogKey is the key username's game logs are published with.
+func GameLogKey(username string) string {
+	return GameLogSlug + "." + username
+}
+
+// GameLogPattern binds to every player's game logs.
+func GameLogPattern() string {
+	return GameLogSlug + ".*"
+}
+
+// GameStateKey is the key game state requests for username are sent with.
+func GameStateKey(username string) string {
+	return GameStatePrefix + "." + username
+}
+
+// PauseQueue is the transient queue a player receives pause messages on.
+func PauseQueue(username string) string {
+	return PauseKey + "." + username
+}
+
+// ArmyMovesQueue is the transient queue a player receives moves on.
+func ArmyMovesQueue(username string) string {
+	return ArmyMovesKey(username)
+}
+
+// GameStateQueue is the transient queue a player answers game state
+// requests on.
+func GameStateQueue(username string) string {
+	return GameStateKey(username)
+}
+
+// ParseKey splits a per-player routing key into its family prefix and
+// username. It fails on keys without a username and on unknown families.
+func ParseKey(key string) (prefix, username string, err error) {
+	prefix, username, ok := strings.Cut(key, ".")
+	if !ok || username == "" || strings.Contains(username, ".") {
+		return "", "", fmt.Errorf("routing key %q: want <family>.<username>", key)
+	}
+	switch prefix {
+	case ArmyMovesPrefix, WarRecognitionsPrefix, GameLogSlug, GameStatePrefix, PauseKey:
+		return prefix, username, nil
+	default:
+		return "", "", fmt.Errorf("routing key %q: unknown family %q", key, prefix)
+	}
+}
+
+// Username returns the username in a per-player routing key.
+func Username(key string) (string, error) {
+	_, username, err := ParseKey(key)
+	return username, err
+}
+
+// Match reports whether key matches a topic binding pattern the way a
+// RabbitMQ topic exchange does: * stands for exactly one word and # for
+// zero or more words. Words may be empty, as in "a..b", but the empty key
+// has no words at all.
+func Match(pattern, key string) bool {
+	return matchWords(splitWords(pattern), splitWords(key))
+}
+
+func splitWords(key string) []string {
+	if key == "" {
+		return nil
+	}
+	return strings.Split(key, ".")
+}
+
+func matchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchWords(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && matchWords(pattern[1:], words[1:])
+	}
+}
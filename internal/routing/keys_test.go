@@ -0,0 +1,99 @@
+package routing
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"a.b", "a.b", true},
+		{"a.b", "a.c", false},
+		{"a.b", "a.b.c", false},
+
+		{"*", "a", true},
+		{"*", "a.b", false},
+		{"*", "", false},
+		{"a.*", "a.b", true},
+		{"a.*", "a", false},
+		{"a.*", "a.b.c", false},
+		{"*.b", "a.b", true},
+		{"*.*", "a.b", true},
+
+		// words may be empty
+		{"a.*", "a.", true},
+		{"a.*.b", "a..b", true},
+		{"*", ".", false},
+		{"*.*", ".", true},
+
+		// # matches zero or more words
+		{"#", "", true},
+		{"#", "a", true},
+		{"#", "a.b.c", true},
+		{"#.#", "", true},
+		{"a.#", "a", true},
+		{"a.#", "a.b.c", true},
+		{"a.#", "b", false},
+		{"#.c", "c", true},
+		{"#.c", "a.b.c", true},
+		{"#.c", "a.b", false},
+		{"a.#.b", "a.b", true},
+		{"a.#.b", "a.x.b", true},
+		{"a.#.b", "a.x.y.b", true},
+		{"a.#.b", "a.b.c", false},
+		{"a.#.b", "b", false},
+		{"#.*", "", false},
+		{"#.*", "a", true},
+
+		{"", "", true},
+		{"", "a", false},
+
+		{ArmyMovesPattern(), ArmyMovesKey("alice"), true},
+		{GameLogPattern(), WarKey("alice"), false},
+	}
+	for _, tt := range tests {
+		got := Match(tt.pattern, tt.key)
+		if got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		key      string
+		prefix   string
+		username string
+		wantErr  bool
+	}{
+		{key: ArmyMovesKey("alice"), prefix: ArmyMovesPrefix, username: "alice"},
+		{key: WarKey("bob"), prefix: WarRecognitionsPrefix, username: "bob"},
+		{key: GameLogKey("carol"), prefix: GameLogSlug, username: "carol"},
+		{key: GameStateKey("dave"), prefix: GameStatePrefix, username: "dave"},
+		{key: PauseQueue("erin"), prefix: PauseKey, username: "erin"},
+
+		{key: "", wantErr: true},
+		{key: ArmyMovesPrefix, wantErr: true},
+		{key: ArmyMovesPrefix + ".", wantErr: true},
+		{key: ArmyMovesPrefix + ".alice.extra", wantErr: true},
+		{key: ".alice", wantErr: true},
+		{key: "unknown.alice", wantErr: true},
+	}
+	for _, tt := range tests {
+		prefix, username, err := ParseKey(tt.key)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseKey(%q) = %q, %q, want an error", tt.key, prefix, username)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseKey(%q): %v", tt.key, err)
+			continue
+		}
+		if prefix != tt.prefix || username != tt.username {
+			t.Errorf("ParseKey(%q) = %q, %q, want %q, %q", tt.key, prefix, username, tt.prefix, tt.username)
+		}
+	}
+}
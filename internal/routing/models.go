@@ -11,3 +11,7 @@ type GameLog struct {
 	Message     string
 	Username    string
 }
+
+type GameStateRequest struct {
+	Username string
+}
@@ -0,0 +1,166 @@
+package routing
+
+import (
+	"fmt"
+	"time"
+)
+
+// QueueType is how RabbitMQ stores a queue.
+type QueueType string
+
+const (
+	// QueueClassic is a queue on a single node, the default.
+	QueueClassic QueueType = "classic"
+	// QueueQuorum is replicated across the cluster with Raft. It must be
+	// durable and cannot be exclusive or auto-delete.
+	QueueQuorum QueueType = "quorum"
+	// QueueStream is an append-only log that consumers read from an
+	// offset without removing messages. Like a quorum queue it must be
+	// durable.
+	QueueStream QueueType = "stream"
+)
+
+// Overflow is what a queue at its maximum length does with a new message.
+type Overflow string
+
+const (
+	// OverflowDropHead dead-letters the oldest message to make room.
+	OverflowDropHead Overflow = "drop-head"
+	// OverflowRejectPublish drops the new message and nacks it to a
+	// publisher using confirms.
+	OverflowRejectPublish Overflow = "reject-publish"
+	// OverflowRejectPublishDLX is OverflowRejectPublish that also
+	// dead-letters the new message. Quorum queues do not support it.
+	OverflowRejectPublishDLX Overflow = "reject-publish-dlx"
+)
+
+// QueueOptions are the arguments a queue is declared with. A queue that
+// exists with other arguments cannot be redeclared, so everyone declaring
+// a queue must use the same options. Durations are written like "30s" in
+// YAML and in nanoseconds in JSON.
+type QueueOptions struct {
+	// Type is classic if empty.
+	Type QueueType `json:"type,omitempty" yaml:"type,omitempty"`
+	// Lazy keeps a classic queue's messages on disk rather than in
+	// memory. RabbitMQ 3.12 and later always do and ignore it.
+	Lazy bool `json:"lazy,omitempty" yaml:"lazy,omitempty"`
+	// MaxLength and MaxLengthBytes bound the ready messages in the queue;
+	// Overflow says what happens to more. Zero means no bound.
+	MaxLength      int64    `json:"max_length,omitempty" yaml:"max_length,omitempty"`
+	MaxLengthBytes int64    `json:"max_length_bytes,omitempty" yaml:"max_length_bytes,omitempty"`
+	Overflow       Overflow `json:"overflow,omitempty" yaml:"overflow,omitempty"`
+	// MessageTTL dead-letters messages that wait longer than it.
+	MessageTTL time.Duration `json:"message_ttl,omitempty" yaml:"message_ttl,omitempty"`
+	// Expires deletes the queue once it has had no consumers for that
+	// long.
+	Expires time.Duration `json:"expires,omitempty" yaml:"expires,omitempty"`
+	// MaxAge is how long a stream keeps messages. Streams drop whole
+	// segments, so messages may be kept a little longer. Zero keeps them
+	// until MaxLengthBytes is reached.
+	MaxAge time.Duration `json:"max_age,omitempty" yaml:"max_age,omitempty"`
+	// MaxPriority makes a classic queue deliver messages with a higher
+	// priority first, for priorities up to it.
+	MaxPriority uint8 `json:"max_priority,omitempty" yaml:"max_priority,omitempty"`
+	// SingleActiveConsumer delivers to one consumer at a time, failing
+	// over to the next when it goes away, so messages stay in order.
+	SingleActiveConsumer bool   `json:"single_active_consumer,omitempty" yaml:"single_active_consumer,omitempty"`
+	DeadLetterExchange   string `json:"dead_letter_exchange,omitempty" yaml:"dead_letter_exchange,omitempty"`
+	// Arguments are passed as they are, for x- arguments without a field
+	// above. The fields win over them.
+	Arguments map[string]any `json:"arguments,omitempty" yaml:"arguments,omitempty"`
+}
+
+// Validate reports options that RabbitMQ would refuse together.
+func (o QueueOptions) Validate() error {
+	switch o.Type {
+	case "", QueueClassic:
+	case QueueQuorum, QueueStream:
+		if o.Lazy {
+			return fmt.Errorf("queue options: lazy is only for classic queues")
+		}
+		if o.MaxPriority > 0 {
+			return fmt.Errorf("queue options: priorities are only for classic queues")
+		}
+	default:
+		return fmt.Errorf("queue options: unknown type %q, want classic, quorum or stream", o.Type)
+	}
+	if o.MaxAge != 0 && o.Type != QueueStream {
+		return fmt.Errorf("queue options: max age is only for streams, queues take a message TTL")
+	}
+	if o.MaxAge < 0 || (o.MaxAge > 0 && o.MaxAge < time.Second) {
+		return fmt.Errorf("queue options: max age %s is under a second", o.MaxAge)
+	}
+	if o.Type == QueueStream && (o.Overflow != "" || o.MessageTTL > 0 || o.Expires > 0 || o.SingleActiveConsumer || o.DeadLetterExchange != "") {
+		return fmt.Errorf("queue options: streams take no overflow, TTL, expiry, single active consumer or dead letter exchange")
+	}
+	switch o.Overflow {
+	case "", OverflowDropHead, OverflowRejectPublish, OverflowRejectPublishDLX:
+	default:
+		return fmt.Errorf("queue options: unknown overflow %q", o.Overflow)
+	}
+	if o.Type == QueueQuorum && o.Overflow == OverflowRejectPublishDLX {
+		return fmt.Errorf("queue options: quorum queues do not support overflow %s, use %s or %s", o.Overflow, OverflowRejectPublish, OverflowDropHead)
+	}
+	if o.MaxLength < 0 || o.MaxLengthBytes < 0 || o.MessageTTL < 0 || o.Expires < 0 {
+		return fmt.Errorf("queue options: lengths and durations cannot be negative")
+	}
+	if o.Expires > 0 && o.Expires < time.Millisecond {
+		return fmt.Errorf("queue options: expires %s is under a millisecond", o.Expires)
+	}
+	return nil
+}
+
+// CheckDeclare reports options that cannot go with how the queue is
+// declared: quorum queues and streams must be durable, and cannot be
+// exclusive or deleted automatically.
+func (o QueueOptions) CheckDeclare(durable, autoDelete, exclusive bool) error {
+	if o.Type != QueueQuorum && o.Type != QueueStream {
+		return nil
+	}
+	if !durable || autoDelete || exclusive {
+		return fmt.Errorf("queue options: %s queues must be durable, not exclusive or auto-delete", o.Type)
+	}
+	return nil
+}
+
+// Table returns the x- arguments for o.
+func (o QueueOptions) Table() map[string]any {
+	args := map[string]any{}
+	for k, v := range o.Arguments {
+		args[k] = v
+	}
+	if o.Type != "" {
+		args["x-queue-type"] = string(o.Type)
+	}
+	if o.Lazy {
+		args["x-queue-mode"] = "lazy"
+	}
+	if o.MaxLength > 0 {
+		args["x-max-length"] = o.MaxLength
+	}
+	if o.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = o.MaxLengthBytes
+	}
+	if o.Overflow != "" {
+		args["x-overflow"] = string(o.Overflow)
+	}
+	if o.MessageTTL > 0 {
+		args["x-message-ttl"] = o.MessageTTL.Milliseconds()
+	}
+	if o.Expires > 0 {
+		args["x-expires"] = o.Expires.Milliseconds()
+	}
+	if o.MaxAge > 0 {
+		args["x-max-age"] = fmt.Sprintf("%ds", int64(o.MaxAge/time.Second))
+	}
+	if o.MaxPriority > 0 {
+		args["x-max-priority"] = int64(o.MaxPriority)
+	}
+	if o.SingleActiveConsumer {
+		args["x-single-active-consumer"] = true
+	}
+	if o.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = o.DeadLetterExchange
+	}
+	return args
+}
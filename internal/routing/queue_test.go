@@ -0,0 +1,33 @@
+package routing
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueueOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		options QueueOptions
+		wantErr bool
+	}{
+		{"defaults", QueueOptions{}, false},
+		{"bounded classic", QueueOptions{MaxLength: 10, Overflow: OverflowRejectPublishDLX}, false},
+		{"bounded quorum", QueueOptions{Type: QueueQuorum, MaxLength: 10, Overflow: OverflowRejectPublish}, false},
+		{"quorum dropping head", QueueOptions{Type: QueueQuorum, MaxLength: 10, Overflow: OverflowDropHead}, false},
+		{"quorum dead-lettering rejects", QueueOptions{Type: QueueQuorum, MaxLength: 10, Overflow: OverflowRejectPublishDLX}, true},
+		{"lazy quorum", QueueOptions{Type: QueueQuorum, Lazy: true}, true},
+		{"unknown type", QueueOptions{Type: "fancy"}, true},
+		{"unknown overflow", QueueOptions{Overflow: "drop-tail"}, true},
+		{"stream with max age", QueueOptions{Type: QueueStream, MaxAge: time.Hour}, false},
+		{"classic with max age", QueueOptions{MaxAge: time.Hour}, true},
+		{"stream with dead letter exchange", QueueOptions{Type: QueueStream, DeadLetterExchange: ExchangePerilDeadLetter}, true},
+		{"negative length", QueueOptions{MaxLength: -1}, true},
+	}
+	for _, tt := range tests {
+		err := tt.options.Validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
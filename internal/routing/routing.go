@@ -8,6 +8,8 @@ const (
 	PauseKey = "pause"
 
 	GameLogSlug = "game_logs"
+
+	GameStatePrefix = "game_state"
 )
 
 const (
@@ -15,3 +17,7 @@ const (
 	ExchangePerilTopic      = "peril_topic"
 	ExchangePerilDeadLetter = "peril_dlx"
 )
+
+const (
+	QueuePerilDeadLetter = "peril_dlq"
+)
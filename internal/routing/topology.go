@@ -0,0 +1,198 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	QueueGameLogs = GameLogSlug
+	QueueWar      = WarRecognitionsPrefix
+	// StreamGameLogs keeps every game log for replay, see WithGameLogStream.
+	StreamGameLogs = "game_logs_stream"
+)
+
+// gameLogRetention is how long StreamGameLogs keeps game logs.
+const gameLogRetention = 30 * 24 * time.Hour
+
+// Topology describes the exchanges, queues and bindings Peril needs on the
+// broker. It can be written in Go or loaded from a YAML or JSON file with
+// LoadTopology.
+type Topology struct {
+	Exchanges []ExchangeSpec `json:"exchanges" yaml:"exchanges"`
+	Queues    []QueueSpec    `json:"queues" yaml:"queues"`
+	Bindings  []BindingSpec  `json:"bindings" yaml:"bindings"`
+}
+
+// ExchangeSpec is a durable exchange.
+type ExchangeSpec struct {
+	Name string `json:"name" yaml:"name"`
+	// Kind is direct, fanout, topic or headers.
+	Kind string `json:"kind" yaml:"kind"`
+}
+
+// QueueSpec is a queue and its arguments. The options are written at the
+// same level as the name in YAML and JSON.
+type QueueSpec struct {
+	Name         string `json:"name" yaml:"name"`
+	Durable      bool   `json:"durable" yaml:"durable"`
+	AutoDelete   bool   `json:"auto_delete" yaml:"auto_delete"`
+	Exclusive    bool   `json:"exclusive" yaml:"exclusive"`
+	QueueOptions `yaml:",inline"`
+}
+
+type BindingSpec struct {
+	Queue    string `json:"queue" yaml:"queue"`
+	Exchange string `json:"exchange" yaml:"exchange"`
+	Key      string `json:"key" yaml:"key"`
+}
+
+// PerilTopology is what the server declares when it is not given a
+// topology file: the three exchanges, the shared durable queues and the
+// dead letter queue. Queues that belong to a single player are declared by
+// the client as it subscribes.
+var PerilTopology = Topology{
+	Exchanges: []ExchangeSpec{
+		{Name: ExchangePerilDirect, Kind: "direct"},
+		{Name: ExchangePerilTopic, Kind: "topic"},
+		{Name: ExchangePerilDeadLetter, Kind: "fanout"},
+	},
+	Queues: []QueueSpec{
+		{
+			Name:         QueueGameLogs,
+			Durable:      true,
+			QueueOptions: QueueOptions{DeadLetterExchange: ExchangePerilDeadLetter},
+		},
+		{
+			Name:         QueueWar,
+			Durable:      true,
+			QueueOptions: QueueOptions{DeadLetterExchange: ExchangePerilDeadLetter},
+		},
+		{Name: QueuePerilDeadLetter, Durable: true},
+	},
+	Bindings: []BindingSpec{
+		{Queue: QueueGameLogs, Exchange: ExchangePerilTopic, Key: GameLogPattern()},
+		{Queue: QueuePerilDeadLetter, Exchange: ExchangePerilDeadLetter, Key: ""},
+	},
+}
+
+// LoadTopology reads a topology from a .json, .yaml or .yml file.
+func LoadTopology(path string) (Topology, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Topology{}, err
+	}
+
+	var t Topology
+	switch filepath.Ext(path) {
+	case ".json":
+		err = json.Unmarshal(data, &t)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &t)
+	default:
+		return Topology{}, fmt.Errorf("topology %s: unknown format, want .json, .yaml or .yml", path)
+	}
+	if err != nil {
+		return Topology{}, fmt.Errorf("topology %s: %w", path, err)
+	}
+	return t, t.Validate()
+}
+
+// WithQueuePrefix returns a copy of t with prefix in front of every queue
+// name, so that several deployments can share a vhost. Exchanges are shared.
+func (t Topology) WithQueuePrefix(prefix string) Topology {
+	if prefix == "" {
+		return t
+	}
+	prefixed := Topology{
+		Exchanges: t.Exchanges,
+		Queues:    make([]QueueSpec, len(t.Queues)),
+		Bindings:  make([]BindingSpec, len(t.Bindings)),
+	}
+	for i, q := range t.Queues {
+		q.Name = prefix + q.Name
+		prefixed.Queues[i] = q
+	}
+	for i, b := range t.Bindings {
+		b.Queue = prefix + b.Queue
+		prefixed.Bindings[i] = b
+	}
+	return prefixed
+}
+
+// WithGameLogStream returns a copy of t that also routes every game log to
+// the StreamGameLogs stream. The server still drains game_logs, while the
+// stream keeps the history for anyone to read from an offset.
+func (t Topology) WithGameLogStream() Topology {
+	t.Queues = append(append([]QueueSpec(nil), t.Queues...), QueueSpec{
+		Name:    StreamGameLogs,
+		Durable: true,
+		QueueOptions: QueueOptions{
+			Type:   QueueStream,
+			MaxAge: gameLogRetention,
+		},
+	})
+	t.Bindings = append(append([]BindingSpec(nil), t.Bindings...), BindingSpec{
+		Queue:    StreamGameLogs,
+		Exchange: ExchangePerilTopic,
+		Key:      GameLogPattern(),
+	})
+	return t
+}
+
+// Queue returns the spec of the queue called name.
+func (t Topology) Queue(name string) (QueueSpec, bool) {
+	for _, q := range t.Queues {
+		if q.Name == name {
+			return q, true
+		}
+	}
+	return QueueSpec{}, false
+}
+
+// Validate checks that no two exchanges or queues share a name, that every
+// queue's options go together and that every binding refers to an exchange
+// and queue the topology declares, or to the default exchange.
+func (t Topology) Validate() error {
+	exchanges := map[string]bool{"": true}
+	for _, e := range t.Exchanges {
+		if e.Name == "" {
+			return fmt.Errorf("topology: exchange without a name")
+		}
+		if exchanges[e.Name] {
+			return fmt.Errorf("topology: exchange %s declared twice", e.Name)
+		}
+		exchanges[e.Name] = true
+	}
+	queues := map[string]bool{}
+	for _, q := range t.Queues {
+		if q.Name == "" {
+			return fmt.Errorf("topology: queue without a name")
+		}
+		if queues[q.Name] {
+			return fmt.Errorf("topology: queue %s declared twice", q.Name)
+		}
+		err := q.Validate()
+		if err == nil {
+			err = q.CheckDeclare(q.Durable, q.AutoDelete, q.Exclusive)
+		}
+		if err != nil {
+			return fmt.Errorf("topology: queue %s: %w", q.Name, err)
+		}
+		queues[q.Name] = true
+	}
+	for _, b := range t.Bindings {
+		if !exchanges[b.Exchange] {
+			return fmt.Errorf("topology: binding of %s refers to undeclared exchange %q", b.Queue, b.Exchange)
+		}
+		if !queues[b.Queue] {
+			return fmt.Errorf("topology: binding from %s refers to undeclared queue %q", b.Exchange, b.Queue)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package routing
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadTopologyExample(t *testing.T) {
+	topology, err := LoadTopology(filepath.Join("..", "..", "topology.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(topology, PerilTopology) {
+		t.Errorf("topology.yaml is not the built-in topology:\n%+v\nwant\n%+v", topology, PerilTopology)
+	}
+}
+
+func TestLoadTopologyFormats(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		err := os.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	topology, err := LoadTopology(write("topology.json", `{
+		"exchanges": [{"name": "peril_topic", "kind": "topic"}],
+		"queues": [{"name": "war", "durable": true, "type": "quorum", "max_length": 100}],
+		"bindings": [{"queue": "war", "exchange": "peril_topic", "key": "war.*"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	war, ok := topology.Queue("war")
+	if !ok || war.Type != QueueQuorum || war.MaxLength != 100 {
+		t.Errorf("war loaded as %+v", war)
+	}
+
+	_, err = LoadTopology(write("topology.toml", ""))
+	if err == nil {
+		t.Error("loaded a .toml file")
+	}
+	_, err = LoadTopology(write("invalid.yaml", "bindings:\n  - queue: war\n    exchange: peril_topic\n"))
+	if err == nil {
+		t.Error("loaded a topology that does not validate")
+	}
+}
+
+func TestTopologyValidate(t *testing.T) {
+	exchanges := []ExchangeSpec{{Name: ExchangePerilTopic, Kind: "topic"}}
+	queues := []QueueSpec{{Name: QueueWar, Durable: true}}
+	tests := []struct {
+		name     string
+		topology Topology
+		wantErr  bool
+	}{
+		{"built in", PerilTopology, false},
+		{"with stream", PerilTopology.WithGameLogStream(), false},
+		{"bound to the default exchange", Topology{Queues: queues, Bindings: []BindingSpec{{Queue: QueueWar, Key: QueueWar}}}, false},
+		{"binding to undeclared exchange", Topology{Queues: queues, Bindings: []BindingSpec{{Queue: QueueWar, Exchange: ExchangePerilDirect}}}, true},
+		{"binding to undeclared queue", Topology{Exchanges: exchanges, Bindings: []BindingSpec{{Queue: QueueWar, Exchange: ExchangePerilTopic}}}, true},
+		{"exchange declared twice", Topology{Exchanges: append(exchanges, ExchangeSpec{Name: ExchangePerilTopic, Kind: "direct"})}, true},
+		{"queue declared twice", Topology{Queues: append(queues, QueueSpec{Name: QueueWar})}, true},
+		{"exchange without a name", Topology{Exchanges: []ExchangeSpec{{Kind: "topic"}}}, true},
+		{"queue without a name", Topology{Queues: []QueueSpec{{Durable: true}}}, true},
+		{"invalid queue options", Topology{Queues: []QueueSpec{{Name: QueueWar, QueueOptions: QueueOptions{Type: QueueQuorum}}}}, true},
+	}
+	for _, tt := range tests {
+		err := tt.topology.Validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTopologyWithQueuePrefix(t *testing.T) {
+	prefixed := PerilTopology.WithQueuePrefix("test_")
+	if _, ok := prefixed.Queue("test_" + QueueGameLogs); !ok {
+		t.Error("game_logs not prefixed")
+	}
+	for _, b := range prefixed.Bindings {
+		if _, ok := prefixed.Queue(b.Queue); !ok {
+			t.Errorf("binding to unprefixed queue %s", b.Queue)
+		}
+	}
+	if err := prefixed.Validate(); err != nil {
+		t.Error(err)
+	}
+	if _, ok := PerilTopology.Queue(QueueGameLogs); !ok {
+		t.Error("prefixing changed the original topology")
+	}
+}
@@ -3,6 +3,7 @@
 # Check if the number of instances was provided
 if [ -z "$1" ]; then
   echo "Usage: $0 <number-of-instances>"
+  echo "Set METRICS_BASE_PORT to serve each instance's metrics on its own port, starting there."
   exit 1
 fi
 
@@ -25,7 +26,11 @@ trap 'cleanup' SIGINT
 
 # Start the specified number of instances of the program in the background
 for (( i=0; i<num_instances; i++ )); do
-  go run ./cmd/server &
+  if [ -n "$METRICS_BASE_PORT" ]; then
+    go run ./cmd/server -metrics ":$((METRICS_BASE_PORT + i))" &
+  else
+    go run ./cmd/server &
+  fi
   pids+=($!)
 done
 